@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+const (
+	BrokerMemory = "memory"
+	BrokerRedis  = "redis"
+)
+
+var ErrBrokerUnknown = errors.New("broker type is unknown")
+
+// Envelope is a websocket message fanned out to every node
+type Envelope struct {
+	UserIds []string `json:"user_ids"`
+	// ExceptClientId skips one session, e.g. the one the message originated from
+	ExceptClientId string          `json:"except_client_id,omitempty"`
+	Message        json.RawMessage `json:"message"`
+}
+
+// Broker publishes envelopes to every subscribed node, including the publisher itself
+type Broker interface {
+	Publish(ctx context.Context, env *Envelope) error
+	// Subscribe returns a channel of every published envelope, closed when ctx is done
+	Subscribe(ctx context.Context) (<-chan *Envelope, error)
+	Close() error
+}
+
+// NewBroker creates the broker selected by BROKER (memory or redis), default is memory
+func NewBroker() (Broker, error) {
+	brokerType, exists := os.LookupEnv("BROKER")
+	if !exists || brokerType == "" {
+		brokerType = BrokerMemory
+	}
+	switch brokerType {
+	case BrokerMemory:
+		return NewMemory(), nil
+	case BrokerRedis:
+		return NewRedis()
+	default:
+		return nil, ErrBrokerUnknown
+	}
+}
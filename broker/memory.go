@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process broker, it only reaches subscribers of the same process
+type Memory struct {
+	mu          sync.RWMutex
+	subscribers map[chan *Envelope]struct{}
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subscribers: make(map[chan *Envelope]struct{}),
+	}
+}
+
+func (m *Memory) Publish(ctx context.Context, env *Envelope) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for sub := range m.subscribers {
+		select {
+		case sub <- env:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context) (<-chan *Envelope, error) {
+	sub := make(chan *Envelope, 256)
+	m.mu.Lock()
+	m.subscribers[sub] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.subscribers, sub)
+		close(sub)
+		m.mu.Unlock()
+	}()
+	return sub, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
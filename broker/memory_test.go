@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// receive waits for the next envelope of sub
+func receive(t *testing.T, sub <-chan *Envelope) *Envelope {
+	t.Helper()
+	select {
+	case env, ok := <-sub:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return env
+	case <-time.After(5 * time.Second):
+		t.Fatal("no envelope received")
+	}
+	return nil
+}
+
+func TestMemoryPublishReachesEverySubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewMemory()
+	subA, err := b.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subB, err := b.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &Envelope{
+		UserIds:        []string{"alice", "bob"},
+		ExceptClientId: "client-1",
+		Message:        json.RawMessage(`{"type":"new_chat"}`),
+	}
+	if err = b.Publish(ctx, env); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []<-chan *Envelope{subA, subB} {
+		got := receive(t, sub)
+		if len(got.UserIds) != 2 || got.ExceptClientId != "client-1" || string(got.Message) != string(env.Message) {
+			t.Fatalf("unexpected envelope %+v", got)
+		}
+	}
+}
+
+func TestMemorySubscriptionClosedWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewMemory()
+	sub, err := b.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case _, ok := <-sub:
+		if ok {
+			t.Fatal("expected the subscription to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not closed")
+	}
+	// Publishing without subscribers does not block
+	if err = b.Publish(context.Background(), &Envelope{Message: json.RawMessage(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+}
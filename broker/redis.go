@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const RedisChannel = "go-gin-chat:ws"
+
+// Redis fans envelopes out to every node through a Redis pub/sub channel
+type Redis struct {
+	Client *redis.Client
+}
+
+func NewRedis() (*Redis, error) {
+	redisUrl, exists := os.LookupEnv("REDIS_URL")
+	if !exists {
+		return nil, errors.New("REDIS_URL is not set")
+	}
+	opts, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &Redis{Client: client}, nil
+}
+
+func (r *Redis) Publish(ctx context.Context, env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return r.Client.Publish(ctx, RedisChannel, b).Err()
+}
+
+func (r *Redis) Subscribe(ctx context.Context) (<-chan *Envelope, error) {
+	pubsub := r.Client.Subscribe(ctx, RedisChannel)
+	// Wait for confirmation so no message published afterwards is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	sub := make(chan *Envelope, 256)
+	go func() {
+		defer close(sub)
+		defer pubsub.Close()
+		msgs := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				var env Envelope
+				if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+					log.Println("Error Unmarshal broker envelope: ", err)
+					continue
+				}
+				select {
+				case sub <- &env:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func (r *Redis) Close() error {
+	return r.Client.Close()
+}
@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// TestRedisPublishReachesOtherNode runs against the Redis of REDIS_URL, it is skipped if unset
+func TestRedisPublishReachesOtherNode(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	publisher, err := NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	subscriber, err := NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	sub, err := subscriber.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &Envelope{
+		UserIds:        []string{"alice"},
+		ExceptClientId: "client-1",
+		Message:        json.RawMessage(`{"type":"new_chat","data":{"text":"hello"}}`),
+	}
+	if err = publisher.Publish(ctx, env); err != nil {
+		t.Fatal(err)
+	}
+	got := receive(t, sub)
+	if len(got.UserIds) != 1 || got.UserIds[0] != "alice" || got.ExceptClientId != "client-1" {
+		t.Fatalf("unexpected envelope %+v", got)
+	}
+	var msg map[string]any
+	if err = json.Unmarshal(got.Message, &msg); err != nil || msg["type"] != "new_chat" {
+		t.Fatalf("unexpected message %s", got.Message)
+	}
+}
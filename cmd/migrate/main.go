@@ -0,0 +1,26 @@
+// Command migrate rewrites direct chats keyed by the receiver's user id
+// to the canonical direct conversation id shared by both participants.
+package main
+
+import (
+	"log"
+
+	"github.com/krissukoco/go-gin-chat/database"
+	"github.com/krissukoco/go-gin-chat/models"
+)
+
+func main() {
+	mongoDb, err := database.NewMongo()
+	if err != nil {
+		panic(err)
+	}
+	if err := models.EnsureConversationIndexes(mongoDb); err != nil {
+		panic(err)
+	}
+	migrated, err := models.MigrateDirectConversations(mongoDb)
+	if err != nil {
+		log.Printf("Migrated %d chats before error\n", migrated)
+		panic(err)
+	}
+	log.Printf("Migrated %d chats to direct conversations\n", migrated)
+}
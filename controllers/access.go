@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/krissukoco/go-gin-chat/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Actions on a conversation checked by the Authorizer
+const (
+	ActionSend = "send"
+	ActionRead = "read"
+	ActionVote = "vote"
+	// ActionManageMembers is any membership operation, the ones below need a role
+	ActionManageMembers = "manage_members"
+	ActionAddMembers    = "add_members"
+	ActionRemoveMember  = "remove_member"
+	ActionPromoteAdmin  = "promote_admin"
+	ActionDemoteAdmin   = "demote_admin"
+	ActionTransferOwner = "transfer_ownership"
+	ActionManageInvites = "manage_invites"
+	ActionEditInfo      = "edit_info"
+	ActionEditSettings  = "edit_settings"
+	ActionPin           = "pin"
+)
+
+// Reasons of an AccessError
+const (
+	ReasonNotParticipant = "not a participant"
+	ReasonNotGroupAdmin  = "only group admins can do this"
+	ReasonNotGroupOwner  = "only the group owner can do this"
+	ReasonNotGroup       = "only possible in groups"
+)
+
+var (
+	// ErrAccessDenied is wrapped by every AccessError, match it with errors.Is
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// AccessError is returned when a user is not allowed to do an action in a conversation
+type AccessError struct {
+	UserId string
+	ChatId string
+	Action string
+	Reason string
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("not allowed to %s in chat %s: %s", e.Action, e.ChatId, e.Reason)
+}
+
+func (e *AccessError) Unwrap() error {
+	return ErrAccessDenied
+}
+
+// ChatAccess is an existing conversation the user was authorized on
+type ChatAccess struct {
+	// ChatId is the canonical chat id
+	ChatId string
+	// Group is set if the conversation is a group
+	Group *models.Group
+	// Conversation is set if the conversation is a direct conversation
+	Conversation *models.Conversation
+}
+
+// Participants returns the user ids taking part in the conversation
+func (a *ChatAccess) Participants() []string {
+	if a.Group != nil {
+		return a.Group.MemberIds
+	}
+	return a.Conversation.ParticipantIds
+}
+
+// groupAccess is the access to a group already loaded and checked by the caller
+func groupAccess(group *models.Group) *ChatAccess {
+	return &ChatAccess{ChatId: group.ObjectId.Hex(), Group: group}
+}
+
+// AccessStore loads the conversations the Authorizer decides on
+type AccessStore interface {
+	FindConversation(id string) (*models.Conversation, error)
+	FindGroup(id string) (*models.Group, error)
+}
+
+type mongoAccessStore struct {
+	db *mongo.Database
+}
+
+func (s *mongoAccessStore) FindConversation(id string) (*models.Conversation, error) {
+	var conv models.Conversation
+	if err := conv.FindById(s.db, id); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+func (s *mongoAccessStore) FindGroup(id string) (*models.Group, error) {
+	var group models.Group
+	err := group.FindById(s.db, id)
+	if err == mongo.ErrNoDocuments {
+		return nil, models.ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// isChatNotFound reports whether a store error means the conversation does not exist,
+// ids that are not valid group ids included. Any other error is a failure of the store.
+func isChatNotFound(err error) bool {
+	return errors.Is(err, models.ErrConversationNotFound) ||
+		errors.Is(err, models.ErrGroupNotFound) ||
+		errors.Is(err, primitive.ErrInvalidHex)
+}
+
+// Authorizer is the single place deciding who can do what in a conversation
+type Authorizer struct {
+	Store AccessStore
+}
+
+func NewAuthorizer(db *mongo.Database) *Authorizer {
+	return &Authorizer{Store: &mongoAccessStore{db: db}}
+}
+
+// Authorize checks the user may do the action in chatId, a group id or a direct conversation id.
+// Returns ErrChatNotFound if the conversation does not exist, an *AccessError if it is not allowed
+// and the store error unchanged if the conversation could not be loaded.
+func (a *Authorizer) Authorize(userId string, chatId string, action string) (*ChatAccess, error) {
+	return a.AuthorizeOn(userId, chatId, action, "")
+}
+
+// AuthorizeOn is Authorize for actions done to another member, targetId
+func (a *Authorizer) AuthorizeOn(userId string, chatId string, action string, targetId string) (*ChatAccess, error) {
+	deny := func(reason string) (*ChatAccess, error) {
+		return nil, &AccessError{UserId: userId, ChatId: chatId, Action: action, Reason: reason}
+	}
+	if models.IsDirectConversationId(chatId) {
+		conv, err := a.Store.FindConversation(chatId)
+		if isChatNotFound(err) {
+			return nil, ErrChatNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !conv.HasParticipant(userId) {
+			return deny(ReasonNotParticipant)
+		}
+		switch action {
+		case ActionSend, ActionRead, ActionVote, ActionPin:
+			return &ChatAccess{ChatId: conv.Id, Conversation: conv}, nil
+		}
+		// Direct conversations have no members, invites or info to manage
+		return deny(ReasonNotGroup)
+	}
+	group, err := a.Store.FindGroup(chatId)
+	if isChatNotFound(err) {
+		return nil, ErrChatNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsMember(userId) {
+		return deny(ReasonNotParticipant)
+	}
+	isAdmin := group.IsAdmin(userId)
+	isOwner := group.IsOwner(userId)
+	switch action {
+	case ActionSend:
+		if group.Settings.OnlyAdminsSend && !isAdmin {
+			return deny(ReasonNotGroupAdmin)
+		}
+	case ActionEditInfo:
+		if group.Settings.OnlyAdminsEditInfo && !isAdmin {
+			return deny(ReasonNotGroupAdmin)
+		}
+	case ActionAddMembers, ActionPromoteAdmin, ActionManageInvites, ActionEditSettings, ActionPin:
+		if !isAdmin {
+			return deny(ReasonNotGroupAdmin)
+		}
+	case ActionRemoveMember:
+		// Admins remove members, only the owner removes admins, nobody removes the owner
+		if !isAdmin {
+			return deny(ReasonNotGroupAdmin)
+		}
+		if group.IsOwner(targetId) || (group.IsAdmin(targetId) && !isOwner) {
+			return deny(ReasonNotGroupOwner)
+		}
+	case ActionDemoteAdmin, ActionTransferOwner:
+		if !isOwner {
+			return deny(ReasonNotGroupOwner)
+		}
+		if action == ActionDemoteAdmin && targetId == userId {
+			// The owner stays admin
+			return deny(ReasonNotGroupOwner)
+		}
+	}
+	return &ChatAccess{ChatId: chatId, Group: group}, nil
+}
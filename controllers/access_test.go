@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/krissukoco/go-gin-chat/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeAccessStore struct {
+	convs  map[string]*models.Conversation
+	groups map[string]*models.Group
+	// err is returned by every lookup when set, like an unreachable database
+	err error
+}
+
+func (s *fakeAccessStore) FindConversation(id string) (*models.Conversation, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	conv, ok := s.convs[id]
+	if !ok {
+		return nil, models.ErrConversationNotFound
+	}
+	return conv, nil
+}
+
+func (s *fakeAccessStore) FindGroup(id string) (*models.Group, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	group, ok := s.groups[id]
+	if !ok {
+		return nil, models.ErrGroupNotFound
+	}
+	return group, nil
+}
+
+func newTestAuthorizer() (*Authorizer, string, string) {
+	dmId := models.DirectConversationId("alice", "bob")
+	group := &models.Group{
+		ObjectId:  primitive.NewObjectID(),
+		MemberIds: []string{"owner", "admin", "member"},
+		AdminIds:  []string{"owner", "admin"},
+		OwnerId:   "owner",
+	}
+	groupId := group.ObjectId.Hex()
+	store := &fakeAccessStore{
+		convs: map[string]*models.Conversation{
+			dmId: {Id: dmId, Type: models.ConversationTypeDirect, ParticipantIds: []string{"alice", "bob"}},
+		},
+		groups: map[string]*models.Group{groupId: group},
+	}
+	return &Authorizer{Store: store}, dmId, groupId
+}
+
+func TestAuthorizeNonMemberDenied(t *testing.T) {
+	auth, dmId, groupId := newTestAuthorizer()
+	actions := []string{ActionSend, ActionRead, ActionVote, ActionManageMembers}
+	for _, chatId := range []string{dmId, groupId} {
+		for _, action := range actions {
+			_, err := auth.Authorize("mallory", chatId, action)
+			if !errors.Is(err, ErrAccessDenied) {
+				t.Fatalf("%s in %s: expected ErrAccessDenied, got %v", action, chatId, err)
+			}
+			var accessErr *AccessError
+			if !errors.As(err, &accessErr) {
+				t.Fatalf("%s in %s: expected *AccessError, got %T", action, chatId, err)
+			}
+			if accessErr.UserId != "mallory" || accessErr.ChatId != chatId || accessErr.Action != action {
+				t.Fatalf("unexpected access error %+v", accessErr)
+			}
+		}
+	}
+}
+
+func TestAuthorizeMemberAllowed(t *testing.T) {
+	auth, dmId, groupId := newTestAuthorizer()
+	for _, action := range []string{ActionSend, ActionRead, ActionVote} {
+		access, err := auth.Authorize("alice", dmId, action)
+		if err != nil {
+			t.Fatalf("%s in direct conversation: %v", action, err)
+		}
+		if access.Conversation == nil || len(access.Participants()) != 2 {
+			t.Fatalf("%s in direct conversation: unexpected access %+v", action, access)
+		}
+		access, err = auth.Authorize("member", groupId, action)
+		if err != nil {
+			t.Fatalf("%s in group: %v", action, err)
+		}
+		if access.Group == nil || len(access.Participants()) != 3 {
+			t.Fatalf("%s in group: unexpected access %+v", action, access)
+		}
+	}
+}
+
+func TestAuthorizeChatNotFound(t *testing.T) {
+	auth, dmId, groupId := newTestAuthorizer()
+	errUnavailable := errors.New("connection refused")
+	cases := []struct {
+		chatId   string
+		storeErr error
+		expected error
+	}{
+		{models.DirectConversationId("x", "y"), nil, ErrChatNotFound},
+		{primitive.NewObjectID().Hex(), nil, ErrChatNotFound},
+		{"u_bob", nil, ErrChatNotFound},
+		{dmId, errUnavailable, errUnavailable},
+		{groupId, errUnavailable, errUnavailable},
+	}
+	for _, tc := range cases {
+		auth.Store.(*fakeAccessStore).err = tc.storeErr
+		if _, err := auth.Authorize("alice", tc.chatId, ActionRead); err != tc.expected {
+			t.Errorf("%s with store error %v: expected %v, got %v", tc.chatId, tc.storeErr, tc.expected, err)
+		}
+	}
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	auth, dmId, groupId := newTestAuthorizer()
+	cases := []struct {
+		userId  string
+		chatId  string
+		action  string
+		target  string
+		allowed bool
+	}{
+		{"member", groupId, ActionManageMembers, "", true},
+		{"member", groupId, ActionAddMembers, "", false},
+		{"admin", groupId, ActionAddMembers, "", true},
+		{"admin", groupId, ActionRemoveMember, "member", true},
+		{"admin", groupId, ActionRemoveMember, "owner", false},
+		{"admin", groupId, ActionRemoveMember, "admin", false},
+		{"owner", groupId, ActionRemoveMember, "admin", true},
+		{"member", groupId, ActionPromoteAdmin, "member", false},
+		{"admin", groupId, ActionPromoteAdmin, "member", true},
+		{"admin", groupId, ActionDemoteAdmin, "admin", false},
+		{"owner", groupId, ActionDemoteAdmin, "admin", true},
+		{"owner", groupId, ActionDemoteAdmin, "owner", false},
+		{"admin", groupId, ActionTransferOwner, "member", false},
+		{"owner", groupId, ActionTransferOwner, "member", true},
+		{"member", groupId, ActionManageInvites, "", false},
+		{"admin", groupId, ActionManageInvites, "", true},
+		{"member", groupId, ActionEditSettings, "", false},
+		{"admin", groupId, ActionEditSettings, "", true},
+		{"member", groupId, ActionEditInfo, "", true},
+		{"member", groupId, ActionPin, "", false},
+		{"admin", groupId, ActionPin, "", true},
+		{"alice", dmId, ActionPin, "", true},
+		{"alice", dmId, ActionManageMembers, "", false},
+		{"alice", dmId, ActionEditInfo, "", false},
+	}
+	for _, tc := range cases {
+		_, err := auth.AuthorizeOn(tc.userId, tc.chatId, tc.action, tc.target)
+		if tc.allowed && err != nil {
+			t.Errorf("%s %s %s: expected allowed, got %v", tc.userId, tc.action, tc.target, err)
+		}
+		if !tc.allowed && !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("%s %s %s: expected ErrAccessDenied, got %v", tc.userId, tc.action, tc.target, err)
+		}
+	}
+}
+
+func TestAuthorizeGroupSettings(t *testing.T) {
+	auth, _, groupId := newTestAuthorizer()
+	group, _ := auth.Store.FindGroup(groupId)
+	group.Settings = models.GroupSettings{OnlyAdminsSend: true, OnlyAdminsEditInfo: true}
+	for _, action := range []string{ActionSend, ActionEditInfo} {
+		if _, err := auth.Authorize("member", groupId, action); !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("%s: expected ErrAccessDenied, got %v", action, err)
+		}
+		if _, err := auth.Authorize("admin", groupId, action); err != nil {
+			t.Fatalf("%s by admin: %v", action, err)
+		}
+	}
+}
@@ -60,6 +60,17 @@ func (reg *RegisterRequest) Validate() (int, string) {
 	return 0, ""
 }
 
+type PrivacyRequest struct {
+	HideLastSeen *bool `json:"hide_last_seen"`
+}
+
+func (req *PrivacyRequest) Validate() (int, string) {
+	if req.HideLastSeen == nil {
+		return schema.ErrFieldRequired, "hide_last_seen is required"
+	}
+	return 0, ""
+}
+
 func (a *Auth) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -179,3 +190,49 @@ func (a *Auth) GetAccount(c *gin.Context) {
 
 	c.JSON(200, &u)
 }
+
+func (a *Auth) UpdatePrivacy(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal Server Error",
+		})
+		return
+	}
+	var req PrivacyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(422, &schema.ErrorResponse{
+			Code:    schema.ErrUnparsableJSON,
+			Message: "Unparsable JSON",
+		})
+		return
+	}
+	code, msg := req.Validate()
+	if code != 0 {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    code,
+			Message: msg,
+		})
+		return
+	}
+
+	var u models.User
+	err := u.FindById(a.Pg, userId)
+	if err != nil {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrTokenInvalid,
+			Message: "Invalid token",
+		})
+		return
+	}
+	if err = u.UpdateHideLastSeen(a.Pg, *req.HideLastSeen); err != nil {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal Server Error",
+		})
+		return
+	}
+
+	c.JSON(200, &u)
+}
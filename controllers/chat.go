@@ -13,18 +13,32 @@ import (
 	"github.com/krissukoco/go-gin-chat/schema"
 	"github.com/krissukoco/go-gin-chat/security"
 	"github.com/krissukoco/go-gin-chat/utils"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var (
 	ErrMessageTypeUnknown = errors.New("message type is unknown")
 	ErrChatNotFound       = errors.New("chat not found")
+	ErrSendToSelf         = errors.New("cannot send to yourself")
 )
 
 type Chat struct {
-	Mongo     *mongo.Database
-	UserCtl   *User // bridge to user controller to get user data
+	Mongo    *mongo.Database
+	UserCtl  *User  // bridge to user controller to get user data
+	GroupCtl *Group // bridge to group controller for membership messages
+	Access   *Authorizer
+	// EditWindow is how long after sending a chat can be edited, zero for no limit
+	EditWindow time.Duration
+	// ReactionConfig restricts the reactions users can add
+	ReactionConfig ReactionConfig
+	// MaxPins is the limit of pinned chats per conversation, zero for no limit
+	MaxPins   int
+	Hub       *WsHub
+	Typing    *TypingTracker
 	JwtSecret string
+	// ClientConfig configures the outbound queue of every websocket client
+	ClientConfig ChatClientConfig
 }
 
 type WsBaseMessage struct {
@@ -32,22 +46,123 @@ type WsBaseMessage struct {
 	Data any    `json:"data"`
 }
 type WsAuthMsg struct {
-	Token string `json:"token"`
+	Token  string    `json:"token"`
+	Device *WsDevice `json:"device"`
 }
 type WsChatMsg struct {
-	Type   string `json:"type"`
+	Type   string     `json:"type"`
+	ChatId string     `json:"chat_id"`
+	Text   string     `json:"text"`
+	Poll   *WsPollMsg `json:"poll,omitempty"`
+	// MediaIds are ids of media uploaded through POST /media, for image and file chats
+	MediaIds []string `json:"media_ids,omitempty"`
+	// ReplyTo is the id of the quoted chat
+	ReplyTo string `json:"reply_to,omitempty"`
+	// ThreadId is the id of the thread's root chat to reply in
+	ThreadId string `json:"thread_id,omitempty"`
+}
+type WsGetMessagesMsg struct {
+	ChatId string `json:"chat_id"`
+	models.ChatPageQuery
+}
+type WsMessagesData struct {
 	ChatId string `json:"chat_id"`
-	Text   string `json:"text"`
+	*models.ChatPage
 }
 type WsChatData struct {
 	*models.Chat
-	Receiver *models.User  `json:"receiver"`
-	Group    *models.Group `json:"group"`
+	Receiver     *models.User         `json:"receiver"`
+	Group        *models.Group        `json:"group"`
+	Conversation *models.Conversation `json:"conversation,omitempty"`
+	// ThreadRoot is the updated root chat if the chat is a thread reply
+	ThreadRoot *models.Chat `json:"-"`
+}
+
+// RecipientIds returns the user ids a new chat should be delivered to, excluding the sender
+func (d *WsChatData) RecipientIds(senderId string) []string {
+	if d.IsGroup && d.Group != nil {
+		ids := make([]string, 0, len(d.Group.MemberIds))
+		for _, id := range d.Group.MemberIds {
+			if id != senderId {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	if d.Receiver != nil {
+		return []string{d.Receiver.Id}
+	}
+	return nil
+}
+
+// GetConversations returns the conversation list of the user with peer user or group info
+func (chat *Chat) GetConversations(userId string, offset int, limit int) ([]*models.ConversationSummary, error) {
+	chatIds, convs, err := chat.userChatIds(userId)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := models.GetConversationSummaries(chat.Mongo, userId, chatIds, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	peerIds := make(map[string]string)
+	for _, conv := range convs {
+		peerIds[conv.Id] = conv.PeerId(userId)
+	}
+	userIds := make([]string, 0)
+	convGroupIds := make([]string, 0)
+	for _, s := range summaries {
+		if s.IsGroup {
+			convGroupIds = append(convGroupIds, s.ChatId)
+		} else {
+			userIds = append(userIds, peerIds[s.ChatId])
+		}
+	}
+	users, err := models.GetUsersByIds(chat.UserCtl.Pg, userIds)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := models.GetGroupsByIds(chat.Mongo, convGroupIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range summaries {
+		if s.IsGroup {
+			s.Group = groups[s.ChatId]
+		} else {
+			s.User = users[peerIds[s.ChatId]]
+		}
+	}
+	return summaries, nil
 }
 
 func (chat *Chat) GetAll(c *gin.Context) {
-	username := c.GetString("username")
-	if username == "" {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	page, err := chat.UserCtl.getPage(c)
+	if err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid page query",
+		})
+		return
+	}
+	size, err := chat.UserCtl.getSize(c)
+	if err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid size query",
+		})
+		return
+	}
+	conversations, err := chat.GetConversations(userId, (page-1)*size, size)
+	if err != nil {
 		c.JSON(500, &schema.ErrorResponse{
 			Code:    schema.ErrInternalServer,
 			Message: "Internal server error",
@@ -55,7 +170,7 @@ func (chat *Chat) GetAll(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{"username": username})
+	c.JSON(200, conversations)
 }
 
 func newWsId() string {
@@ -63,12 +178,20 @@ func newWsId() string {
 }
 
 func (chat *Chat) GetAllChats(userId string) ([]*models.ChatRoom, error) {
+	chatIds, convs, err := chat.userChatIds(userId)
+	if err != nil {
+		return nil, err
+	}
+	peerIds := make(map[string]string)
+	for _, conv := range convs {
+		peerIds[conv.Id] = conv.PeerId(userId)
+	}
 	// Get all chats
-	chats, err := models.GetUserChatRooms(chat.Mongo, userId)
+	chats, err := models.GetUserChatRooms(chat.Mongo, userId, chatIds)
 	for _, room := range chats {
 		// Get user data if room is user chat
-		if room.ChatId[:2] == "u_" {
-			room.User, err = chat.UserCtl.GetUserById(room.ChatId)
+		if peerId, ok := peerIds[room.ChatId]; ok {
+			room.User, err = chat.UserCtl.GetUserById(peerId)
 			if err != nil {
 				return nil, err
 			}
@@ -77,7 +200,86 @@ func (chat *Chat) GetAllChats(userId string) ([]*models.ChatRoom, error) {
 	return chats, err
 }
 
-func (chat *Chat) ChatWebsocketHandler(c *gin.Context, newClient chan *ChatClient) {
+// GetMessages returns a page of the conversation history of chatId,
+// a group id, a direct conversation id or the other user's id
+func (chat *Chat) GetMessages(userId string, chatId string, q *models.ChatPageQuery) (*models.ChatPage, error) {
+	chatId, err := chat.resolveChatId(userId, chatId, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	return models.GetChatPage(chat.Mongo, bson.M{
+		"chat_id":     chatId,
+		"deleted_for": bson.M{"$ne": userId},
+		"thread_id":   bson.M{"$exists": false},
+	}, q)
+}
+
+func (chat *Chat) GetChatMessages(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var q models.ChatPageQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid query",
+		})
+		return
+	}
+	page, err := chat.GetMessages(userId, c.Param("chatId"), &q)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.JSON(200, page)
+}
+
+// respondChatError writes the error response for errors of chat operations
+func respondChatError(c *gin.Context, err error) {
+	if errors.Is(err, ErrAccessDenied) {
+		c.JSON(403, &schema.ErrorResponse{
+			Code:    schema.ErrPermissionDenied,
+			Message: err.Error(),
+		})
+		return
+	}
+	switch err {
+	case ErrChatNotFound:
+		c.JSON(404, &schema.ErrorResponse{
+			Code:    schema.ErrResourceNotFound,
+			Message: "Chat not found",
+		})
+	case ErrNotChatSender:
+		c.JSON(403, &schema.ErrorResponse{
+			Code:    schema.ErrPermissionDenied,
+			Message: err.Error(),
+		})
+	case ErrEditWindowExpired, models.ErrChatNotEditable, ErrInvalidSchema, ErrReplyNotFound,
+		models.ErrReactionLimit, ErrInvalidReaction,
+		models.ErrPinLimit, models.ErrChatNotPinnable, models.ErrChatNotPinned:
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: err.Error(),
+		})
+	case models.ErrInvalidCursor:
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid cursor",
+		})
+	default:
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+	}
+}
+
+func (chat *Chat) ChatWebsocketHandler(c *gin.Context) {
 	wsIntf, exists := c.Get("ws")
 	if !exists {
 		c.JSON(500, &schema.ErrorResponse{
@@ -95,25 +297,59 @@ func (chat *Chat) ChatWebsocketHandler(c *gin.Context, newClient chan *ChatClien
 		return
 	}
 
-	// Create and process new client
-	client := NewChatClient("anon", ws)
-	newClient <- client
+	// Create and process new client, it is registered to the hub once authenticated
+	client := NewChatClient("anon", ws, chat.ClientConfig)
+	wsMetrics.ActiveConnections.Add(1)
+	defer wsMetrics.ActiveConnections.Add(-1)
+	go client.writePump()
 	// Process client websocket
 	chat.clientWebsocket(client)
-	// Wait until ws process finished then send exited
+	// Wait until ws process finished then unregister
 	log.Println("Client exited")
-	client.Exited <- true
+	if client.Authenticated {
+		chat.disconnect(client)
+	}
+	client.Shutdown()
+}
+
+// GetSessions returns the live websocket sessions (devices) of the current user
+func (chat *Chat) GetSessions(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	c.JSON(200, chat.Hub.Sessions.Sessions(userId))
+}
+
+// GetWsMetrics returns websocket connection and eviction counters
+func (chat *Chat) GetWsMetrics(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	c.JSON(200, GetWsMetrics())
 }
 
 func (chat *Chat) clientWebsocket(cl *ChatClient) {
+	cl.startHeartbeat()
 	for {
-		mt, msg, err := cl.Conn.ReadMessage()
+		_, msg, err := cl.Conn.ReadMessage()
 		if err != nil {
 			log.Println("Error ReadMessage: ", err)
+			cl.readError(err)
 			break
 		}
+		cl.touch()
 		if string(msg) == "ping" {
-			cl.Conn.WriteMessage(mt, []byte("pong"))
+			cl.SendJson(&WsBaseMessage{Type: "pong"})
 			continue
 		}
 		var m WsBaseMessage
@@ -125,7 +361,7 @@ func (chat *Chat) clientWebsocket(cl *ChatClient) {
 		// Process message
 		err = chat.processMessage(cl, &m)
 		if err != nil {
-			cl.sendJson(&WsBaseMessage{
+			cl.SendJson(&WsBaseMessage{
 				Type: "error",
 				Data: map[string]string{
 					"message": err.Error(),
@@ -135,13 +371,53 @@ func (chat *Chat) clientWebsocket(cl *ChatClient) {
 	}
 }
 
+// processMessage handles a client message. Errors caused by the message itself are sent back
+// as an 'error' message and the connection stays open, any other error closes the connection.
 func (chat *Chat) processMessage(cl *ChatClient, m *WsBaseMessage) error {
 	log.Println("Processing message: ", m)
+	err := chat.dispatchMessage(cl, m)
+	if err == nil || !isClientError(err) {
+		return err
+	}
+	return cl.SendJson(&WsBaseMessage{
+		Type: "error",
+		Data: map[string]string{
+			"type":    m.Type,
+			"message": err.Error(),
+		},
+	})
+}
+
+// isClientError tells whether err is a rejection of a message rather than a connection or server failure
+func isClientError(err error) bool {
+	if errors.Is(err, ErrAccessDenied) {
+		return true
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return true
+	}
+	switch err {
+	case ErrMessageTypeUnknown, ErrInvalidSchema, ErrChatNotFound, ErrSendToSelf, ErrReplyNotFound,
+		ErrNotChatSender, ErrEditWindowExpired, ErrChatNotForwardable, ErrMediaInvalid,
+		ErrInvalidPollOption, ErrNotPollCreator, ErrInvalidReaction,
+		ErrNotGroupMember, ErrAlreadyGroupMember, ErrOwnerCannotLeave, ErrMemberNotFound,
+		models.ErrPollNotFound, models.ErrReactionLimit, models.ErrChatNotEditable, models.ErrInvalidCursor,
+		models.ErrPinLimit, models.ErrChatNotPinnable, models.ErrChatNotPinned,
+		models.ErrConversationNotFound, models.ErrGroupNotFound, models.ErrUserNotFound:
+		return true
+	}
+	return false
+}
+
+// dispatchMessage runs the handler of the message type
+func (chat *Chat) dispatchMessage(cl *ChatClient, m *WsBaseMessage) error {
 	switch m.Type {
 	// User authentication
 	case "auth":
 		if cl.Authenticated {
-			return cl.sendJson(&WsBaseMessage{
+			return cl.SendJson(&WsBaseMessage{
 				Type: "error",
 				Data: map[string]string{"message": "already authenticated"},
 			})
@@ -164,12 +440,17 @@ func (chat *Chat) processMessage(cl *ChatClient, m *WsBaseMessage) error {
 			log.Println("Error FindUserById: ", err)
 			break
 		}
+		if authMsg.Device != nil {
+			cl.Device = *authMsg.Device
+		}
 		cl.Authenticated = true
-		cl.sendJson(&WsBaseMessage{
+		chat.connect(cl)
+		cl.SendJson(&WsBaseMessage{
 			Type: "success",
 			Data: map[string]interface{}{
 				"message": "authenticated",
 				"user":    user,
+				"session": cl.Session(),
 			},
 		})
 		log.Println("Client is authenticated")
@@ -185,37 +466,29 @@ func (chat *Chat) processMessage(cl *ChatClient, m *WsBaseMessage) error {
 		}
 		// process chat by type
 		switch chatData.Type {
-		case "text":
+		case models.ChatTypeText:
 			if chatData.Text == "" {
 				return ErrInvalidSchema
 			}
-			// Save chat to database
-			now := time.Now().UnixMilli()
-			chatModel := models.Chat{
-				SenderId:  cl.UserId,
-				ChatId:    chatData.ChatId,
-				Type:      "text",
-				Text:      chatData.Text,
-				ReadBy:    make([]string, 0),
-				CreatedAt: now,
-				UpdatedAt: now,
-			}
-			log.Println("Chat data: ", chatModel)
-			chatExtended, err := chat.processClientChat(cl, &chatModel)
+			chatModel := newClientChat(cl, &chatData)
+			chatModel.Text = chatData.Text
+			return chat.sendChat(cl, chatModel)
+		case models.ChatTypePoll:
+			poll, err := chatData.Poll.toPoll()
 			if err != nil {
 				return err
 			}
-			// Send back to sender
-			chatMsg := &WsBaseMessage{
-				Type: "chat_sent",
-				Data: chatExtended,
-			}
-			if err = cl.sendJson(chatMsg); err != nil {
+			chatModel := newClientChat(cl, &chatData)
+			chatModel.Poll = poll
+			return chat.sendChat(cl, chatModel)
+		case models.ChatTypeImage, models.ChatTypeFile:
+			chatModel := newClientChat(cl, &chatData)
+			// Text is an optional caption
+			chatModel.Text = chatData.Text
+			if err = chat.attachMedia(chatModel, chatData.MediaIds); err != nil {
 				return err
 			}
-			// Send to receiver(s)
-			chatMsg.Type = "new_chat"
-			cl.Out <- chatMsg
+			return chat.sendChat(cl, chatModel)
 
 		default:
 			return ErrInvalidSchema
@@ -228,10 +501,168 @@ func (chat *Chat) processMessage(cl *ChatClient, m *WsBaseMessage) error {
 		if err != nil {
 			return err
 		}
-		cl.sendJson(&WsBaseMessage{
+		cl.SendJson(&WsBaseMessage{
 			Type: "chats",
 			Data: chats,
 		})
+	case "get_messages":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var q WsGetMessagesMsg
+		err := utils.ConvertStruct(m.Data, &q)
+		if err != nil {
+			return err
+		}
+		page, err := chat.GetMessages(cl.UserId, q.ChatId, &q.ChatPageQuery)
+		if err != nil {
+			return err
+		}
+		cl.SendJson(&WsBaseMessage{
+			Type: "messages",
+			Data: &WsMessagesData{
+				ChatId:   q.ChatId,
+				ChatPage: page,
+			},
+		})
+
+	case "get_thread":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var q WsGetThreadMsg
+		err := utils.ConvertStruct(m.Data, &q)
+		if err != nil {
+			return err
+		}
+		thread, err := chat.GetThread(cl.UserId, q.ChatId, q.MessageId, &q.ChatPageQuery)
+		if err != nil {
+			return err
+		}
+		cl.SendJson(&WsBaseMessage{
+			Type: "thread",
+			Data: thread,
+		})
+
+	case "mark_read", "mark_delivered":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var markMsg WsMarkMsg
+		err := utils.ConvertStruct(m.Data, &markMsg)
+		if err != nil {
+			return err
+		}
+		receipt := models.ReceiptRead
+		if m.Type == "mark_delivered" {
+			receipt = models.ReceiptDelivered
+		}
+		return chat.MarkChats(cl, markMsg.ChatId, markMsg.UpTo, receipt)
+	// Ephemeral signals, never persisted
+	case "typing_start", "typing_stop":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var typingMsg WsTypingMsg
+		err := utils.ConvertStruct(m.Data, &typingMsg)
+		if err != nil {
+			return err
+		}
+		if m.Type == "typing_start" {
+			return chat.TypingStart(cl, typingMsg.ChatId)
+		}
+		return chat.TypingStop(cl, typingMsg.ChatId)
+	// Polls
+	case "vote_poll", "retract_poll_vote":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var voteMsg WsVotePollMsg
+		err := utils.ConvertStruct(m.Data, &voteMsg)
+		if err != nil {
+			return err
+		}
+		if m.Type == "retract_poll_vote" {
+			voteMsg.OptionIndexes = nil
+		}
+		return chat.VotePoll(cl.UserId, voteMsg.MessageId, voteMsg.OptionIndexes)
+	case "close_poll":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var closeMsg WsClosePollMsg
+		err := utils.ConvertStruct(m.Data, &closeMsg)
+		if err != nil {
+			return err
+		}
+		return chat.ClosePoll(cl.UserId, closeMsg.MessageId)
+	// Edits
+	case "edit_chat":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var editMsg WsEditChatMsg
+		err := utils.ConvertStruct(m.Data, &editMsg)
+		if err != nil {
+			return err
+		}
+		_, err = chat.EditChat(cl.UserId, "", editMsg.MessageId, editMsg.Text)
+		return err
+	case "delete_chat":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var deleteMsg WsDeleteChatMsg
+		err := utils.ConvertStruct(m.Data, &deleteMsg)
+		if err != nil {
+			return err
+		}
+		return chat.DeleteChat(cl.UserId, "", deleteMsg.MessageId, deleteMsg.For)
+	// Forwarding
+	case "forward_chat":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var forwardMsg WsForwardChatMsg
+		err := utils.ConvertStruct(m.Data, &forwardMsg)
+		if err != nil {
+			return err
+		}
+		return chat.ForwardChat(cl, forwardMsg.MessageId, forwardMsg.TargetChatIds)
+	// Reactions
+	case "react", "unreact":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var reactMsg WsReactMsg
+		err := utils.ConvertStruct(m.Data, &reactMsg)
+		if err != nil {
+			return err
+		}
+		return chat.React(cl.UserId, reactMsg.MessageId, reactMsg.Emoji, m.Type == "react")
+	// Pins
+	case "pin_chat", "unpin_chat":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var pinMsg WsPinMsg
+		err := utils.ConvertStruct(m.Data, &pinMsg)
+		if err != nil {
+			return err
+		}
+		_, err = chat.Pin(cl.UserId, pinMsg.ChatId, pinMsg.MessageId, m.Type == "pin_chat")
+		return err
+	// Group membership
+	case "add_members", "remove_member", "leave_group", "promote_admin", "demote_admin", "transfer_ownership":
+		if !cl.Authenticated {
+			return ErrAbortConnection
+		}
+		var memberMsg WsGroupMemberMsg
+		err := utils.ConvertStruct(m.Data, &memberMsg)
+		if err != nil {
+			return err
+		}
+		return chat.GroupCtl.processMemberMessage(cl, m.Type, &memberMsg)
 
 	default:
 		return ErrMessageTypeUnknown
@@ -239,44 +670,101 @@ func (chat *Chat) processMessage(cl *ChatClient, m *WsBaseMessage) error {
 	return nil
 }
 
+// newClientChat returns a new chat of the client's user from a 'send_chat' message
+func newClientChat(cl *ChatClient, chatData *WsChatMsg) *models.Chat {
+	now := time.Now().UnixMilli()
+	chatModel := &models.Chat{
+		SenderId:    cl.UserId,
+		ChatId:      chatData.ChatId,
+		Type:        chatData.Type,
+		ThreadId:    chatData.ThreadId,
+		MediaUrls:   make([]string, 0),
+		ReadBy:      make([]string, 0),
+		DeliveredTo: make([]string, 0),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if chatData.ReplyTo != "" {
+		// The quote is filled once the conversation is resolved
+		chatModel.ReplyTo = &models.ChatReplyRef{MessageId: chatData.ReplyTo}
+	}
+	return chatModel
+}
+
+// sendChat saves the chat and delivers it to the sender's sessions and the receiver(s)
+func (chat *Chat) sendChat(cl *ChatClient, chatModel *models.Chat) error {
+	// Save chat to database
+	log.Println("Chat data: ", chatModel)
+	chatExtended, err := chat.processClientChat(cl, chatModel)
+	if err != nil {
+		return err
+	}
+	// Send back to sender
+	chatMsg := &WsBaseMessage{
+		Type: "chat_sent",
+		Data: chatExtended,
+	}
+	if err = cl.SendJson(chatMsg); err != nil {
+		return err
+	}
+	// Keep sender's other devices in sync
+	chat.Hub.broadcastToOtherSessions(cl, chatMsg)
+	// Send to receiver(s), thread replies only reach the thread participants
+	recipients := chatExtended.RecipientIds(cl.UserId)
+	if chatExtended.ThreadRoot != nil {
+		recipients = threadRecipients(chatExtended, cl.UserId)
+		chat.broadcastThreadUpdate(chatExtended, cl.UserId)
+	}
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: "new_chat",
+		Data: chatExtended,
+	}, recipients...)
+	// Sending a chat ends the typing indicator
+	chat.stopTyping(cl.UserId, chatExtended.ChatId)
+	return nil
+}
+
 func (chat *Chat) processClientChat(client *ChatClient, chatData *models.Chat) (*WsChatData, error) {
 	log.Println("Listening to chat data...")
 	if chatData.ChatId == "" {
-		return nil, errors.New("chat id cannot be empty")
-	}
-	// User cannot send to themselves
-	if chatData.SenderId == chatData.ChatId {
-		return nil, errors.New("cannot send to yourself")
+		return nil, ErrInvalidSchema
 	}
 	var data WsChatData
 	// Find group chat
-	var group models.Group
-	err := group.FindById(chat.Mongo, chatData.ChatId)
-	if err == nil {
-		// Group exists
+	access, err := chat.Access.Authorize(chatData.SenderId, chatData.ChatId, ActionSend)
+	if err != nil && err != ErrChatNotFound {
+		return nil, err
+	}
+	if access != nil && access.Group != nil {
 		chatData.IsGroup = true
-		data.Group = &group
-		err = chatData.Save(chat.Mongo)
+		data.Group = access.Group
+	} else {
+		// Direct message, chat id is either the conversation id or the receiver's user id
+		conv, receiver, err := chat.directConversation(chatData.SenderId, chatData.ChatId)
 		if err != nil {
-			log.Println("ERROR saving group chat data to mongo: ", err)
+			log.Println("ERROR finding conversation: ", err)
 			return nil, err
 		}
+		chatData.ChatId = conv.Id
+		data.Conversation = conv
+		data.Receiver = receiver
+	}
+	root, err := chat.resolveReply(chatData)
+	if err != nil {
+		return nil, err
 	}
-
-	// Find by user id
-	user, err := chat.UserCtl.GetUserById(chatData.ChatId)
-	if err != nil && !chatData.IsGroup {
-		// No group nor user found
-		log.Println("ERROR finding user: ", err)
-		return nil, ErrChatNotFound
-	}
-	data.Receiver = user
 	log.Println("New chat data: ", chatData)
 	err = chatData.Save(chat.Mongo)
 	if err != nil {
 		log.Println("ERROR saving chat data to mongo: ", err)
 		return nil, err
 	}
+	if root != nil {
+		data.ThreadRoot, err = models.AddThreadReply(chat.Mongo, chatData.ThreadId, chatData.SenderId, chatData.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
 	data.Chat = chatData
 	return &data, nil
 }
@@ -1,8 +1,14 @@
 package controllers
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/krissukoco/go-gin-chat/models"
@@ -11,32 +17,176 @@ import (
 var (
 	ErrAbortConnection = errors.New("connection is aborted either by server or client")
 	ErrInvalidSchema   = errors.New("invalid message schema")
+	ErrSendQueueFull   = errors.New("send queue is full")
 )
 
+// Policies applied when a client's send queue is full
+const (
+	// QueuePolicyDrop drops the new message
+	QueuePolicyDrop = "drop"
+	// QueuePolicyDisconnect closes the connection of the slow client
+	QueuePolicyDisconnect = "disconnect"
+	// QueuePolicyCoalesce merges every pending message and the new one into a single 'batch' message,
+	// a batch growing over MaxBatchBytes disconnects the client
+	QueuePolicyCoalesce = "coalesce"
+)
+
+// batchPrefix starts every encoded 'batch' message
+var batchPrefix = []byte(`{"type":"batch",`)
+
+type ChatClientConfig struct {
+	// SendQueueSize is the maximum number of outbound messages waiting to be written
+	SendQueueSize int
+	// QueuePolicy is one of QueuePolicyDrop, QueuePolicyDisconnect or QueuePolicyCoalesce
+	QueuePolicy string
+	// MaxBatchBytes is the largest 'batch' message QueuePolicyCoalesce builds
+	MaxBatchBytes int
+	// WriteTimeout is the deadline for a single write to the peer
+	WriteTimeout time.Duration
+	// PingInterval is how often a ping control frame is sent, must be less than PongTimeout
+	PingInterval time.Duration
+	// PongTimeout is how long the server waits for a pong (or any message) before evicting the client
+	PongTimeout time.Duration
+	// IdleTimeout evicts clients that send no application message for this long, zero disables it
+	IdleTimeout time.Duration
+	// MaxLifetime evicts clients connected for longer than this, zero disables it
+	MaxLifetime time.Duration
+}
+
+func DefaultChatClientConfig() ChatClientConfig {
+	return ChatClientConfig{
+		SendQueueSize: 64,
+		QueuePolicy:   QueuePolicyDrop,
+		MaxBatchBytes: 1 << 20,
+		WriteTimeout:  10 * time.Second,
+		PingInterval:  30 * time.Second,
+		PongTimeout:   60 * time.Second,
+	}
+}
+
+// WsMetrics counts websocket connections and the reasons clients were evicted
+type WsMetrics struct {
+	ActiveConnections  atomic.Int64
+	EvictedPongTimeout atomic.Int64
+	EvictedIdle        atomic.Int64
+	EvictedMaxLifetime atomic.Int64
+	EvictedSlowClient  atomic.Int64
+}
+
+var wsMetrics WsMetrics
+
+// GetWsMetrics returns a snapshot of the websocket metrics
+func GetWsMetrics() map[string]int64 {
+	return map[string]int64{
+		"active_connections":   wsMetrics.ActiveConnections.Load(),
+		"evicted_pong_timeout": wsMetrics.EvictedPongTimeout.Load(),
+		"evicted_idle":         wsMetrics.EvictedIdle.Load(),
+		"evicted_max_lifetime": wsMetrics.EvictedMaxLifetime.Load(),
+		"evicted_slow_client":  wsMetrics.EvictedSlowClient.Load(),
+	}
+}
+
+// WsDevice is the device metadata a client sends with its 'auth' message
+type WsDevice struct {
+	// Id is a client generated identifier, stable across reconnects of the same device
+	Id string `json:"id"`
+	// Type is e.g. 'phone', 'desktop' or 'web'
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// WsSession describes a live websocket session of a user
+type WsSession struct {
+	Id          string   `json:"id"`
+	UserId      string   `json:"user_id"`
+	Device      WsDevice `json:"device"`
+	ConnectedAt int64    `json:"connected_at"`
+}
+
 type ChatClient struct {
 	UserId        string
 	Id            string
 	Authenticated bool
+	Device        WsDevice
 	Conn          *websocket.Conn
 	In            chan *WsBaseMessage
-	Out           chan *WsBaseMessage
 	ChatData      chan *models.Chat
-	Exited        chan bool
+
+	config      ChatClientConfig
+	send        chan []byte
+	sendMu      sync.Mutex
+	connectedAt time.Time
+	// lastActivity is the unix nano time of the last application message
+	lastActivity atomic.Int64
+	closed       chan struct{}
+	closeOnce    sync.Once
+	quit         chan struct{}
+	quitOnce     sync.Once
+	pumpDone     chan struct{}
+}
+
+func NewChatClient(userId string, connection *websocket.Conn, config ChatClientConfig) *ChatClient {
+	if config.SendQueueSize < 1 {
+		config.SendQueueSize = 1
+	}
+	now := time.Now()
+	cl := &ChatClient{
+		UserId:      userId,
+		Conn:        connection,
+		Id:          newWsId(),
+		In:          make(chan *WsBaseMessage),
+		ChatData:    make(chan *models.Chat),
+		config:      config,
+		send:        make(chan []byte, config.SendQueueSize),
+		connectedAt: now,
+		closed:      make(chan struct{}),
+		quit:        make(chan struct{}),
+		pumpDone:    make(chan struct{}),
+	}
+	cl.lastActivity.Store(now.UnixNano())
+	return cl
 }
 
-func NewChatClient(userId string, connection *websocket.Conn) *ChatClient {
-	return &ChatClient{
-		UserId:   userId,
-		Conn:     connection,
-		Id:       newWsId(),
-		In:       make(chan *WsBaseMessage),
-		Out:      make(chan *WsBaseMessage),
-		Exited:   make(chan bool),
-		ChatData: make(chan *models.Chat),
+func (cl *ChatClient) Session() *WsSession {
+	return &WsSession{
+		Id:          cl.Id,
+		UserId:      cl.UserId,
+		Device:      cl.Device,
+		ConnectedAt: cl.connectedAt.UnixMilli(),
 	}
 }
 
-func (cl *ChatClient) sendJson(m any) error {
+// startHeartbeat sets the read deadline which is extended by every pong or message received
+func (cl *ChatClient) startHeartbeat() {
+	if cl.config.PongTimeout <= 0 {
+		return
+	}
+	cl.Conn.SetReadDeadline(time.Now().Add(cl.config.PongTimeout))
+	cl.Conn.SetPongHandler(func(string) error {
+		return cl.Conn.SetReadDeadline(time.Now().Add(cl.config.PongTimeout))
+	})
+}
+
+// touch records an application message from the client
+func (cl *ChatClient) touch() {
+	now := time.Now()
+	cl.lastActivity.Store(now.UnixNano())
+	if cl.config.PongTimeout > 0 {
+		cl.Conn.SetReadDeadline(now.Add(cl.config.PongTimeout))
+	}
+}
+
+// readError records an eviction if the read loop ended because the peer stopped answering pings
+func (cl *ChatClient) readError(err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Println("Pong timeout, evicting client: ", cl.Id)
+		wsMetrics.EvictedPongTimeout.Add(1)
+	}
+}
+
+// SendJson queues m to be written by the client's write pump.
+// It never blocks on the network.
+func (cl *ChatClient) SendJson(m any) error {
 	if cl.Conn == nil {
 		return nil
 	}
@@ -44,5 +194,183 @@ func (cl *ChatClient) sendJson(m any) error {
 	if err != nil {
 		return err
 	}
-	return cl.Conn.WriteMessage(1, b)
+	return cl.enqueue(b)
+}
+
+// SendRaw queues an already encoded JSON message
+func (cl *ChatClient) SendRaw(b []byte) error {
+	if cl.Conn == nil {
+		return nil
+	}
+	return cl.enqueue(b)
+}
+
+func (cl *ChatClient) enqueue(b []byte) error {
+	cl.sendMu.Lock()
+	defer cl.sendMu.Unlock()
+	select {
+	case <-cl.closed:
+		return ErrAbortConnection
+	default:
+	}
+	select {
+	case cl.send <- b:
+		return nil
+	default:
+	}
+	// Queue is full
+	switch cl.config.QueuePolicy {
+	case QueuePolicyDisconnect:
+		return cl.disconnectSlow()
+	case QueuePolicyCoalesce:
+		err := cl.coalesce(b)
+		if err == ErrSendQueueFull {
+			return cl.disconnectSlow()
+		}
+		return err
+	default:
+		log.Println("Send queue full, dropping message for client: ", cl.Id)
+		return nil
+	}
+}
+
+// disconnectSlow closes the connection of a client which cannot keep up with its messages
+func (cl *ChatClient) disconnectSlow() error {
+	log.Println("Send queue full, disconnecting client: ", cl.Id)
+	wsMetrics.EvictedSlowClient.Add(1)
+	cl.Close()
+	return ErrSendQueueFull
+}
+
+// coalesce drains the queue and requeues its messages together with b as one 'batch' message,
+// batches already queued are flattened into it. Returns ErrSendQueueFull if the batch would exceed
+// MaxBatchBytes. Caller must hold sendMu.
+func (cl *ChatClient) coalesce(b []byte) error {
+	batch := make([]json.RawMessage, 0, len(cl.send)+1)
+	size := len(b)
+drain:
+	for {
+		select {
+		case pending := <-cl.send:
+			size += len(pending)
+			if !bytes.HasPrefix(pending, batchPrefix) {
+				batch = append(batch, pending)
+				continue
+			}
+			var queued struct {
+				Data []json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(pending, &queued); err != nil {
+				return err
+			}
+			batch = append(batch, queued.Data...)
+		default:
+			break drain
+		}
+	}
+	if cl.config.MaxBatchBytes > 0 && size > cl.config.MaxBatchBytes {
+		return ErrSendQueueFull
+	}
+	batch = append(batch, b)
+	merged, err := json.Marshal(&WsBaseMessage{
+		Type: "batch",
+		Data: batch,
+	})
+	if err != nil {
+		return err
+	}
+	cl.send <- merged
+	return nil
+}
+
+// writePump is the only goroutine writing to the connection.
+// It also sends pings and evicts idle or expired clients on every ping tick.
+func (cl *ChatClient) writePump() {
+	defer close(cl.pumpDone)
+	var tick <-chan time.Time
+	if cl.config.PingInterval > 0 {
+		ticker := time.NewTicker(cl.config.PingInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-cl.closed:
+			return
+		case <-cl.quit:
+			cl.flush()
+			cl.Close()
+			return
+		case b := <-cl.send:
+			if err := cl.write(websocket.TextMessage, b); err != nil {
+				log.Println("Error WriteMessage: ", err)
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					wsMetrics.EvictedSlowClient.Add(1)
+				}
+				cl.Close()
+				return
+			}
+		case now := <-tick:
+			if cl.config.IdleTimeout > 0 && now.Sub(time.Unix(0, cl.lastActivity.Load())) > cl.config.IdleTimeout {
+				log.Println("Idle timeout, evicting client: ", cl.Id)
+				wsMetrics.EvictedIdle.Add(1)
+				cl.evict("idle timeout")
+				return
+			}
+			if cl.config.MaxLifetime > 0 && now.Sub(cl.connectedAt) > cl.config.MaxLifetime {
+				log.Println("Max lifetime reached, evicting client: ", cl.Id)
+				wsMetrics.EvictedMaxLifetime.Add(1)
+				cl.evict("max lifetime reached")
+				return
+			}
+			if err := cl.write(websocket.PingMessage, nil); err != nil {
+				log.Println("Error WritePing: ", err)
+				cl.Close()
+				return
+			}
+		}
+	}
+}
+
+func (cl *ChatClient) write(messageType int, b []byte) error {
+	cl.Conn.SetWriteDeadline(time.Now().Add(cl.config.WriteTimeout))
+	return cl.Conn.WriteMessage(messageType, b)
+}
+
+// flush writes whatever is still queued, used before a graceful close
+func (cl *ChatClient) flush() {
+	for {
+		select {
+		case b := <-cl.send:
+			if err := cl.write(websocket.TextMessage, b); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// evict sends a close frame with the reason then closes the connection
+func (cl *ChatClient) evict(reason string) {
+	cl.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	cl.Close()
+}
+
+// Shutdown flushes pending messages, closes the connection and waits for the write pump to exit
+func (cl *ChatClient) Shutdown() {
+	cl.quitOnce.Do(func() {
+		close(cl.quit)
+	})
+	<-cl.pumpDone
+}
+
+// Close stops the write pump and closes the connection, which also ends the read loop
+func (cl *ChatClient) Close() {
+	cl.closeOnce.Do(func() {
+		close(cl.closed)
+		if cl.Conn != nil {
+			cl.Conn.Close()
+		}
+	})
 }
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/krissukoco/go-gin-chat/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// userChatIds returns the ids of every group and direct conversation the user takes part in
+func (chat *Chat) userChatIds(userId string) ([]string, []*models.Conversation, error) {
+	groupIds, err := models.GetUserGroupIds(chat.Mongo, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	convs, err := models.GetUserConversations(chat.Mongo, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	chatIds := groupIds
+	for _, conv := range convs {
+		chatIds = append(chatIds, conv.Id)
+	}
+	return chatIds, convs, nil
+}
+
+// resolveChatId returns the canonical chat id the user may do the action in,
+// chatId being a group id, a direct conversation id or the other user's id
+func (chat *Chat) resolveChatId(userId string, chatId string, action string) (string, error) {
+	access, err := chat.Access.Authorize(userId, chatId, action)
+	if err == nil {
+		return access.ChatId, nil
+	}
+	if err != ErrChatNotFound || models.IsDirectConversationId(chatId) {
+		return "", err
+	}
+	// Not a conversation, the other user's id
+	if _, err := chat.UserCtl.GetUserById(chatId); err != nil {
+		return "", ErrChatNotFound
+	}
+	return models.DirectConversationId(userId, chatId), nil
+}
+
+// directConversation returns the direct conversation between sender and chatId
+// (a direct conversation id or the receiver's user id) and the receiver
+func (chat *Chat) directConversation(senderId string, chatId string) (*models.Conversation, *models.User, error) {
+	receiverId := chatId
+	if models.IsDirectConversationId(chatId) {
+		access, err := chat.Access.Authorize(senderId, chatId, ActionSend)
+		if err != nil {
+			return nil, nil, err
+		}
+		receiverId = access.Conversation.PeerId(senderId)
+	}
+	if receiverId == senderId {
+		return nil, nil, ErrSendToSelf
+	}
+	receiver, err := chat.UserCtl.GetUserById(receiverId)
+	if err != nil {
+		return nil, nil, ErrChatNotFound
+	}
+	conv, err := models.FindOrCreateDirectConversation(chat.Mongo, senderId, receiverId, time.Now().UnixMilli())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conv, receiver, nil
+}
+
+// chatParticipants returns the user ids taking part in the canonical chat id
+func (chat *Chat) chatParticipants(chatId string) ([]string, error) {
+	return conversationParticipants(chat.Mongo, chatId)
+}
+
+// conversationParticipants returns the user ids taking part in a canonical chat id
+func conversationParticipants(db *mongo.Database, chatId string) ([]string, error) {
+	if models.IsDirectConversationId(chatId) {
+		return models.DirectConversationParticipants(chatId), nil
+	}
+	var group models.Group
+	if err := group.FindById(db, chatId); err != nil {
+		return nil, ErrChatNotFound
+	}
+	return group.MemberIds, nil
+}
+
+// except returns ids without userId
+func except(ids []string, userId string) []string {
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != userId {
+			res = append(res, id)
+		}
+	}
+	return res
+}
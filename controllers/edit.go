@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+)
+
+const (
+	// DefaultEditWindow is how long after sending a chat can be edited
+	DefaultEditWindow = 15 * time.Minute
+
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+var (
+	ErrNotChatSender     = errors.New("only the sender can do this")
+	ErrEditWindowExpired = errors.New("chat can no longer be edited")
+)
+
+type WsEditChatMsg struct {
+	MessageId string `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+type WsDeleteChatMsg struct {
+	MessageId string `json:"message_id"`
+	// For is 'me' (default) or 'everyone'
+	For string `json:"for"`
+}
+
+// WsChatUpdateData is the data of 'chat_edited' and 'chat_deleted'
+type WsChatUpdateData struct {
+	ChatId    string `json:"chat_id"`
+	MessageId string `json:"message_id"`
+	// For is set on deletions
+	For  string       `json:"for,omitempty"`
+	Chat *models.Chat `json:"chat,omitempty"`
+}
+
+type EditChatRequest struct {
+	Text string `json:"text"`
+}
+
+// findChatMessage returns the chat of messageId if the user may do the action in its conversation,
+// chatId restricts it to one conversation unless empty
+func (chat *Chat) findChatMessage(userId string, chatId string, messageId string, action string) (*models.Chat, error) {
+	var c models.Chat
+	if err := c.FindByMessageId(chat.Mongo, messageId); err != nil {
+		return nil, ErrChatNotFound
+	}
+	if chatId != "" {
+		resolved, err := chat.resolveChatId(userId, chatId, ActionRead)
+		if err != nil || resolved != c.ChatId {
+			return nil, ErrChatNotFound
+		}
+	}
+	if _, err := chat.resolveChatId(userId, c.ChatId, action); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// EditChat replaces the text of the user's chat within the edit window
+func (chat *Chat) EditChat(userId string, chatId string, messageId string, text string) (*models.Chat, error) {
+	if text == "" {
+		return nil, ErrInvalidSchema
+	}
+	c, err := chat.findChatMessage(userId, chatId, messageId, ActionSend)
+	if err != nil {
+		return nil, err
+	}
+	if c.SenderId != userId {
+		return nil, ErrNotChatSender
+	}
+	if !c.IsEditable() {
+		return nil, models.ErrChatNotEditable
+	}
+	now := time.Now()
+	var notBefore int64
+	if chat.EditWindow > 0 {
+		notBefore = now.Add(-chat.EditWindow).UnixMilli()
+		if c.CreatedAt < notBefore {
+			return nil, ErrEditWindowExpired
+		}
+	}
+	updated, err := models.EditChat(chat.Mongo, messageId, userId, text, notBefore, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return updated, chat.broadcastChatUpdate("chat_edited", &WsChatUpdateData{
+		ChatId:    updated.ChatId,
+		MessageId: messageId,
+		Chat:      updated,
+	})
+}
+
+// DeleteChat deletes a chat for the user only, or turns the user's own chat into a tombstone for everyone
+func (chat *Chat) DeleteChat(userId string, chatId string, messageId string, deleteFor string) error {
+	c, err := chat.findChatMessage(userId, chatId, messageId, ActionRead)
+	if err != nil {
+		return err
+	}
+	data := &WsChatUpdateData{
+		ChatId:    c.ChatId,
+		MessageId: messageId,
+		For:       deleteFor,
+	}
+	switch deleteFor {
+	case DeleteForEveryone:
+		if c.SenderId != userId {
+			return ErrNotChatSender
+		}
+		tombstone, err := models.DeleteChatForEveryone(chat.Mongo, messageId, userId, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		data.Chat = tombstone
+		return chat.broadcastChatUpdate("chat_deleted", data)
+	case DeleteForMe, "":
+		data.For = DeleteForMe
+		if err = models.DeleteChatForUser(chat.Mongo, messageId, userId); err != nil {
+			return err
+		}
+		// Only the user's own sessions hide it
+		chat.Hub.broadcast(&WsBaseMessage{Type: "chat_deleted", Data: data}, userId)
+		return nil
+	default:
+		return ErrInvalidSchema
+	}
+}
+
+// broadcastChatUpdate sends the event to every session of the conversation's participants
+func (chat *Chat) broadcastChatUpdate(event string, data *WsChatUpdateData) error {
+	participants, err := chat.chatParticipants(data.ChatId)
+	if err != nil {
+		return err
+	}
+	chat.Hub.broadcast(&WsBaseMessage{Type: event, Data: data}, participants...)
+	return nil
+}
+
+func (chat *Chat) PatchChatMessage(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var req EditChatRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrUnparsableJSON,
+			Message: "Unparsable request",
+		})
+		return
+	}
+	if req.Text == "" {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldRequired,
+			Message: "Text is required",
+		})
+		return
+	}
+	updated, err := chat.EditChat(userId, c.Param("chatId"), c.Param("messageId"), req.Text)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.JSON(200, updated)
+}
+
+func (chat *Chat) DeleteChatMessage(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	err := chat.DeleteChat(userId, c.Param("chatId"), c.Param("messageId"), c.DefaultQuery("for", DeleteForMe))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.Status(204)
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/krissukoco/go-gin-chat/models"
+)
+
+const (
+	// MaxForwardTargets is the number of conversations a chat can be forwarded to at once
+	MaxForwardTargets = 10
+)
+
+var (
+	ErrChatNotForwardable = errors.New("chat cannot be forwarded")
+)
+
+type WsForwardChatMsg struct {
+	MessageId string `json:"message_id"`
+	// TargetChatIds are group ids, direct conversation ids or user ids
+	TargetChatIds []string `json:"target_chat_ids"`
+}
+
+// forwardCopy returns a new chat of the user with the content of the source chat
+func forwardCopy(userId string, chatId string, source *models.Chat) *models.Chat {
+	now := time.Now().UnixMilli()
+	c := &models.Chat{
+		SenderId:    userId,
+		ChatId:      chatId,
+		Type:        source.Type,
+		Text:        source.Text,
+		MediaIds:    append([]string(nil), source.MediaIds...),
+		MediaUrls:   append(make([]string, 0, len(source.MediaUrls)), source.MediaUrls...),
+		Forwarded:   source.ForwardInfo(),
+		ReadBy:      make([]string, 0),
+		DeliveredTo: make([]string, 0),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if source.Poll != nil {
+		// Forwarded polls start over, votes stay in the source conversation
+		c.Poll = source.Poll.Snapshot()
+	}
+	return c
+}
+
+// WsForwardResult is the outcome of forwarding to one target, Chat is set on success
+type WsForwardResult struct {
+	TargetChatId string       `json:"target_chat_id"`
+	Chat         *models.Chat `json:"chat,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// WsForwardData is the data of 'chat_forwarded'
+type WsForwardData struct {
+	MessageId string             `json:"message_id"`
+	Results   []*WsForwardResult `json:"results"`
+}
+
+// ForwardChat copies a chat the client's user can read into every target conversation.
+// A target that cannot be resolved, authorized or sent to does not stop the others,
+// the client receives the result of every target in a 'chat_forwarded' message.
+func (chat *Chat) ForwardChat(cl *ChatClient, messageId string, targetChatIds []string) error {
+	if len(targetChatIds) == 0 || len(targetChatIds) > MaxForwardTargets {
+		return ErrInvalidSchema
+	}
+	source, err := chat.findChatMessage(cl.UserId, "", messageId, ActionRead)
+	if err != nil {
+		return err
+	}
+	if source.Deleted || source.Type == models.ChatTypeInfo {
+		return ErrChatNotForwardable
+	}
+	results := make([]*WsForwardResult, 0, len(targetChatIds))
+	seen := make(map[string]bool)
+	for _, target := range targetChatIds {
+		result := &WsForwardResult{TargetChatId: target}
+		results = append(results, result)
+		if target == cl.UserId {
+			result.Error = ErrSendToSelf.Error()
+			continue
+		}
+		canonicalId, err := chat.resolveChatId(cl.UserId, target, ActionSend)
+		if err != nil {
+			result.Error = forwardError(err)
+			continue
+		}
+		if seen[canonicalId] {
+			result.Error = "duplicate target"
+			continue
+		}
+		seen[canonicalId] = true
+		c := forwardCopy(cl.UserId, target, source)
+		if err = chat.sendChat(cl, c); err != nil {
+			result.Error = forwardError(err)
+			continue
+		}
+		result.Chat = c
+	}
+	return cl.SendJson(&WsBaseMessage{
+		Type: "chat_forwarded",
+		Data: &WsForwardData{MessageId: messageId, Results: results},
+	})
+}
+
+// forwardError is the error of a target reported to the client, server failures are only logged
+func forwardError(err error) string {
+	if isClientError(err) {
+		return err.Error()
+	}
+	log.Println("ERROR forwarding chat: ", err)
+	return "internal server error"
+}
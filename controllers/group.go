@@ -1,16 +1,25 @@
 package controllers
 
 import (
+	"context"
+	"errors"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/krissukoco/go-gin-chat/models"
 	"github.com/krissukoco/go-gin-chat/schema"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Group struct {
 	Mongo *mongo.Database
+	// ChatCtl is used to deliver group timeline messages
+	ChatCtl *Chat
+	// MediaCtl signs the download urls of group avatars
+	MediaCtl *Media
 }
 
 type NewGroupRequest struct {
@@ -18,10 +27,68 @@ type NewGroupRequest struct {
 	MemberIds []string `json:"member_ids"`
 }
 
+const (
+	MaxGroupNameLength        = 100
+	MaxGroupDescriptionLength = 500
+)
+
+var (
+	ErrInvalidAvatar = errors.New("avatar must be an image uploaded by the user")
+)
+
 func (req *NewGroupRequest) Validate() (int, string) {
 	if req.Name == "" {
 		return schema.ErrFieldRequired, "Name is required"
 	}
+	if len(req.Name) > MaxGroupNameLength {
+		return schema.ErrFieldMaxChar, "Name is too long"
+	}
+	return 0, ""
+}
+
+// GroupListItem is a group of the user's group list
+type GroupListItem struct {
+	*models.Group
+	MemberCount int `json:"member_count"`
+}
+
+// GroupMember is a member profile with their role in the group
+type GroupMember struct {
+	*models.User
+	// Role is 'owner', 'admin' or 'member'
+	Role string `json:"role"`
+}
+
+// GroupDetail is a group with the profiles of its members
+type GroupDetail struct {
+	*models.Group
+	Members []*GroupMember `json:"members"`
+}
+
+// UpdateGroupRequest is a partial update of the group, nil fields are left unchanged
+type UpdateGroupRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	// AvatarMediaId is an uploaded image, empty removes the avatar
+	AvatarMediaId *string                `json:"avatar_media_id"`
+	Settings      *UpdateSettingsRequest `json:"settings"`
+}
+
+type UpdateSettingsRequest struct {
+	OnlyAdminsSend     *bool `json:"only_admins_send"`
+	OnlyAdminsEditInfo *bool `json:"only_admins_edit_info"`
+}
+
+func (req *UpdateGroupRequest) Validate() (int, string) {
+	if req.Name != nil && *req.Name == "" {
+		return schema.ErrFieldRequired, "Name is required"
+	}
+	if req.Name != nil && len(*req.Name) > MaxGroupNameLength {
+		return schema.ErrFieldMaxChar, "Name is too long"
+	}
+	if req.Description != nil && len(*req.Description) > MaxGroupDescriptionLength {
+		return schema.ErrFieldMaxChar, "Description is too long"
+	}
 	return 0, ""
 }
 
@@ -51,21 +118,22 @@ func (g *Group) CreateNew(c *gin.Context) {
 		return
 	}
 	// Create and save group
-	memberIds := req.MemberIds
-	if memberIds == nil {
-		memberIds = []string{}
+	memberIds, err := g.validateMembers(append([]string{userId}, req.MemberIds...))
+	if err != nil {
+		respondGroupError(c, err)
+		return
 	}
-	memberIds = append(memberIds, userId)
 	now := time.Now().UnixMilli()
 	group := &models.Group{
 		Name:      req.Name,
 		MemberIds: memberIds,
 		AdminIds:  []string{userId},
+		OwnerId:   userId,
 		CreatedAt: now,
 		CreatedBy: userId,
 		UpdatedAt: now,
 	}
-	err := group.Save(g.Mongo)
+	err = group.Save(g.Mongo)
 	if err != nil {
 		c.JSON(500, &schema.ErrorResponse{
 			Code:    schema.ErrInternalServer,
@@ -73,5 +141,239 @@ func (g *Group) CreateNew(c *gin.Context) {
 		})
 		return
 	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoGroupCreated,
+		UserId:    userId,
+		Message:   "Group created",
+		Timestamp: now,
+	})
 	c.JSON(200, group)
 }
+
+// GetDetail returns the group with hydrated member profiles, only members can see it
+func (g *Group) GetDetail(userId string, groupId string) (*GroupDetail, error) {
+	access, err := g.ChatCtl.Access.Authorize(userId, groupId, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	group := access.Group
+	if group == nil {
+		return nil, ErrChatNotFound
+	}
+	users, err := models.GetUsersByIds(g.ChatCtl.UserCtl.Pg, group.MemberIds)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]*GroupMember, 0, len(group.MemberIds))
+	for _, id := range group.MemberIds {
+		user, ok := users[id]
+		if !ok {
+			continue
+		}
+		role := "member"
+		if group.IsOwner(id) {
+			role = "owner"
+		} else if group.IsAdmin(id) {
+			role = "admin"
+		}
+		members = append(members, &GroupMember{User: user, Role: role})
+	}
+	g.signAvatar(group)
+	return &GroupDetail{Group: group, Members: members}, nil
+}
+
+// signAvatar sets the signed download url of the group avatar, it is left empty
+// while the image is processing or if the url cannot be signed
+func (g *Group) signAvatar(group *models.Group) {
+	group.AvatarUrl = ""
+	if group.AvatarMediaId == "" || g.MediaCtl == nil {
+		return
+	}
+	var media models.Media
+	if err := media.FindById(g.Mongo, group.AvatarMediaId); err != nil {
+		log.Println("Error FindById group avatar: ", err)
+		return
+	}
+	if err := g.MediaCtl.signUrl(context.Background(), &media); err != nil {
+		log.Println("Error signing group avatar url: ", err)
+		return
+	}
+	group.AvatarUrl = media.Url
+}
+
+func (g *Group) GetAll(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	page, err := g.ChatCtl.UserCtl.getPage(c)
+	if err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid page query",
+		})
+		return
+	}
+	size, err := g.ChatCtl.UserCtl.getSize(c)
+	if err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid size query",
+		})
+		return
+	}
+	groups, err := models.GetUserGroupsPage(g.Mongo, userId, (page-1)*size, size)
+	if err != nil {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	items := make([]*GroupListItem, 0, len(groups))
+	for _, group := range groups {
+		g.signAvatar(group)
+		items = append(items, &GroupListItem{Group: group, MemberCount: len(group.MemberIds)})
+	}
+	c.JSON(200, items)
+}
+
+func (g *Group) GetById(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	detail, err := g.GetDetail(userId, c.Param("id"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.JSON(200, detail)
+}
+
+// UpdateInfo applies the partial update to the group and posts an info chat for every change.
+// Settings can only be changed by admins, the rest by whoever the settings allow.
+func (g *Group) UpdateInfo(userId string, groupId string, req *UpdateGroupRequest) (*models.Group, error) {
+	access, err := g.ChatCtl.Access.Authorize(userId, groupId, ActionEditInfo)
+	if err != nil {
+		return nil, err
+	}
+	group := access.Group
+	if group == nil {
+		return nil, ErrChatNotFound
+	}
+	fields := bson.M{}
+	infos := make([]*models.ChatInfo, 0)
+	if req.Name != nil && *req.Name != group.Name {
+		fields["name"] = *req.Name
+		infos = append(infos, &models.ChatInfo{
+			Type:    models.ChatInfoNameChanged,
+			Message: "Group name changed to " + *req.Name,
+		})
+	}
+	if req.Description != nil && *req.Description != group.Description {
+		fields["description"] = *req.Description
+		infos = append(infos, &models.ChatInfo{
+			Type:    models.ChatInfoDescChanged,
+			Message: "Group description changed",
+		})
+	}
+	if req.AvatarMediaId != nil && *req.AvatarMediaId != group.AvatarMediaId {
+		fields["avatar_media_id"] = *req.AvatarMediaId
+		if *req.AvatarMediaId != "" {
+			var media models.Media
+			if err := media.FindById(g.Mongo, *req.AvatarMediaId); err != nil ||
+				media.OwnerId != userId || !strings.HasPrefix(media.MimeType, "image/") {
+				return nil, ErrInvalidAvatar
+			}
+		}
+		infos = append(infos, &models.ChatInfo{
+			Type:    models.ChatInfoAvatarChanged,
+			Message: "Group avatar changed",
+		})
+	}
+	if req.Settings != nil {
+		settings := group.Settings
+		if req.Settings.OnlyAdminsSend != nil {
+			settings.OnlyAdminsSend = *req.Settings.OnlyAdminsSend
+		}
+		if req.Settings.OnlyAdminsEditInfo != nil {
+			settings.OnlyAdminsEditInfo = *req.Settings.OnlyAdminsEditInfo
+		}
+		if settings != group.Settings {
+			if _, err := g.ChatCtl.Access.Authorize(userId, groupId, ActionEditSettings); err != nil {
+				return nil, err
+			}
+			fields["settings"] = settings
+			infos = append(infos, &models.ChatInfo{
+				Type:    models.ChatInfoSettingsChanged,
+				Message: "Group settings changed",
+			})
+		}
+	}
+	if len(fields) == 0 {
+		return group, nil
+	}
+	now := time.Now().UnixMilli()
+	if err = group.SetFields(g.Mongo, fields, now); err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		info.UserId = userId
+		info.Timestamp = now
+		g.ChatCtl.postInfo(groupAccess(group), info)
+	}
+	return group, nil
+}
+
+func (g *Group) Update(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var req UpdateGroupRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrUnparsableJSON,
+			Message: "Unparsable request",
+		})
+		return
+	}
+	code, msg := req.Validate()
+	if code != 0 {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    code,
+			Message: msg,
+		})
+		return
+	}
+	group, err := g.UpdateInfo(userId, c.Param("id"), &req)
+	g.respondGroup(c, group, err)
+}
+
+// union returns the distinct ids of every list
+func union(lists ...[]string) []string {
+	res := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, ids := range lists {
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				res = append(res, id)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+)
+
+type NewInviteRequest struct {
+	// ExpiresIn is the lifetime of the invite in seconds, zero never expires
+	ExpiresIn int64 `json:"expires_in"`
+	// MaxUses is zero for unlimited uses
+	MaxUses          int  `json:"max_uses"`
+	RequiresApproval bool `json:"requires_approval"`
+}
+
+func (req *NewInviteRequest) Validate() (int, string) {
+	if req.ExpiresIn < 0 {
+		return schema.ErrFieldInvalid, "Expiry cannot be negative"
+	}
+	if req.MaxUses < 0 {
+		return schema.ErrFieldInvalid, "Max uses cannot be negative"
+	}
+	return 0, ""
+}
+
+// JoinResponse is the result of joining with an invite,
+// Request is set instead of Group if the invite requires approval
+type JoinResponse struct {
+	Group   *models.Group            `json:"group,omitempty"`
+	Request *models.GroupJoinRequest `json:"request,omitempty"`
+}
+
+// adminGroup returns the group the user can manage invites and join requests of
+func (g *Group) adminGroup(userId string, groupId string) (*models.Group, error) {
+	return g.memberGroup(userId, groupId, ActionManageInvites, "")
+}
+
+// Join adds the user to the group of the invite, or queues a join request if the invite requires approval.
+// Members and users with a pending join request are rejected before the invite use is counted.
+func (g *Group) Join(userId string, code string) (*JoinResponse, error) {
+	var invite models.GroupInvite
+	var group models.Group
+	now := time.Now().UnixMilli()
+	if err := invite.FindByCode(g.Mongo, code, now); err != nil {
+		return nil, err
+	}
+	if err := group.FindById(g.Mongo, invite.GroupId); err != nil {
+		return nil, models.ErrInviteInvalid
+	}
+	if group.IsMember(userId) {
+		return nil, ErrAlreadyGroupMember
+	}
+	pending, err := models.HasPendingJoinRequest(g.Mongo, invite.GroupId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		return nil, models.ErrJoinRequestPending
+	}
+	if err := invite.Use(g.Mongo, code, now); err != nil {
+		return nil, err
+	}
+	if invite.RequiresApproval {
+		req, err := models.CreateJoinRequest(g.Mongo, invite.GroupId, userId, code, now)
+		if err != nil {
+			return nil, err
+		}
+		g.ChatCtl.Hub.broadcast(&WsBaseMessage{
+			Type: "join_request",
+			Data: req,
+		}, group.AdminIds...)
+		return &JoinResponse{Request: req}, nil
+	}
+	if err := group.AddMembers(g.Mongo, []string{userId}, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(&group), &models.ChatInfo{
+		Type:      models.ChatInfoMemberJoined,
+		UserId:    userId,
+		Message:   "Member joined with an invite link",
+		Timestamp: now,
+	})
+	return &JoinResponse{Group: &group}, nil
+}
+
+// DecideJoinRequest approves or rejects a pending join request, only admins can decide
+func (g *Group) DecideJoinRequest(userId string, groupId string, requestId string, approve bool) (*models.GroupJoinRequest, error) {
+	group, err := g.adminGroup(userId, groupId)
+	if err != nil {
+		return nil, err
+	}
+	status := models.JoinRequestRejected
+	if approve {
+		status = models.JoinRequestApproved
+	}
+	now := time.Now().UnixMilli()
+	req, err := models.DecideJoinRequest(g.Mongo, groupId, requestId, status, userId, now)
+	if err != nil {
+		return nil, err
+	}
+	if !approve {
+		g.ChatCtl.Hub.broadcast(&WsBaseMessage{
+			Type: "join_request_rejected",
+			Data: req,
+		}, req.UserId)
+		return req, nil
+	}
+	if err = group.AddMembers(g.Mongo, []string{req.UserId}, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoMemberAdded,
+		UserId:    userId,
+		TargetIds: []string{req.UserId},
+		Message:   "Join request approved",
+		Timestamp: now,
+	})
+	return req, nil
+}
+
+func (g *Group) PostInvite(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var req NewInviteRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrUnparsableJSON,
+			Message: "Unparsable request",
+		})
+		return
+	}
+	code, msg := req.Validate()
+	if code != 0 {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    code,
+			Message: msg,
+		})
+		return
+	}
+	group, err := g.adminGroup(userId, c.Param("id"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	inviteCode, err := models.NewInviteCode()
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	now := time.Now().UnixMilli()
+	invite := &models.GroupInvite{
+		Code:             inviteCode,
+		GroupId:          group.ObjectId.Hex(),
+		CreatedBy:        userId,
+		CreatedAt:        now,
+		MaxUses:          req.MaxUses,
+		RequiresApproval: req.RequiresApproval,
+	}
+	if req.ExpiresIn > 0 {
+		invite.ExpiresAt = now + req.ExpiresIn*1000
+	}
+	if err = invite.Save(g.Mongo); err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.JSON(200, invite)
+}
+
+func (g *Group) GetInvites(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.adminGroup(userId, c.Param("id"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	invites, err := models.GetGroupInvites(g.Mongo, group.ObjectId.Hex())
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.JSON(200, invites)
+}
+
+func (g *Group) DeleteInvite(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.adminGroup(userId, c.Param("id"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	if err = models.RevokeGroupInvite(g.Mongo, group.ObjectId.Hex(), c.Param("code")); err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.Status(204)
+}
+
+func (g *Group) PostJoin(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	res, err := g.Join(userId, c.Param("code"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	if res.Request != nil {
+		c.JSON(202, res)
+		return
+	}
+	g.signAvatar(res.Group)
+	c.JSON(200, res)
+}
+
+func (g *Group) GetJoinRequests(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.adminGroup(userId, c.Param("id"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	reqs, err := models.GetPendingJoinRequests(g.Mongo, group.ObjectId.Hex())
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.JSON(200, reqs)
+}
+
+func (g *Group) PostApproveJoinRequest(c *gin.Context) {
+	g.decideJoinRequest(c, true)
+}
+
+func (g *Group) PostRejectJoinRequest(c *gin.Context) {
+	g.decideJoinRequest(c, false)
+}
+
+func (g *Group) decideJoinRequest(c *gin.Context, approve bool) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	req, err := g.DecideJoinRequest(userId, c.Param("id"), c.Param("requestId"), approve)
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.JSON(200, req)
+}
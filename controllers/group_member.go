@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+)
+
+var (
+	ErrNotGroupMember     = errors.New("user is not a member of the group")
+	ErrAlreadyGroupMember = errors.New("user is already a member of the group")
+	ErrOwnerCannotLeave   = errors.New("transfer the ownership before leaving the group")
+	ErrMemberNotFound     = errors.New("member not found")
+)
+
+// WsGroupMemberMsg is the data of the membership messages:
+// 'add_members', 'remove_member', 'leave_group', 'promote_admin', 'demote_admin' and 'transfer_ownership'
+type WsGroupMemberMsg struct {
+	GroupId string   `json:"group_id"`
+	UserIds []string `json:"user_ids"`
+	UserId  string   `json:"user_id"`
+}
+
+type MembersRequest struct {
+	UserIds []string `json:"user_ids"`
+}
+
+type TransferOwnershipRequest struct {
+	UserId string `json:"user_id"`
+}
+
+// validateMembers dedupes the user ids and checks every user exists
+func (g *Group) validateMembers(userIds []string) ([]string, error) {
+	res := make([]string, 0, len(userIds))
+	seen := make(map[string]bool)
+	for _, id := range userIds {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := g.ChatCtl.UserCtl.GetUserById(id); err != nil {
+			if err == models.ErrUserNotFound {
+				return nil, ErrMemberNotFound
+			}
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// memberGroup returns the group the user is allowed to do the membership action in,
+// targetId is the member the action is done to if any
+func (g *Group) memberGroup(userId string, groupId string, action string, targetId string) (*models.Group, error) {
+	access, err := g.ChatCtl.Access.AuthorizeOn(userId, groupId, action, targetId)
+	if err != nil {
+		return nil, err
+	}
+	if access.Group == nil {
+		return nil, ErrChatNotFound
+	}
+	return access.Group, nil
+}
+
+// AddMembers adds the users to the group, only admins can add members
+func (g *Group) AddMembers(userId string, groupId string, userIds []string) (*models.Group, error) {
+	group, err := g.memberGroup(userId, groupId, ActionAddMembers, "")
+	if err != nil {
+		return nil, err
+	}
+	userIds, err = g.validateMembers(userIds)
+	if err != nil {
+		return nil, err
+	}
+	added := make([]string, 0, len(userIds))
+	for _, id := range userIds {
+		if !group.IsMember(id) {
+			added = append(added, id)
+		}
+	}
+	if len(added) == 0 {
+		return group, nil
+	}
+	now := time.Now().UnixMilli()
+	if err = group.AddMembers(g.Mongo, added, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoMemberAdded,
+		UserId:    userId,
+		TargetIds: added,
+		Message:   "Members added",
+		Timestamp: now,
+	})
+	return group, nil
+}
+
+// RemoveMember removes a member from the group. Admins can remove members,
+// only the owner can remove admins and the owner cannot be removed.
+func (g *Group) RemoveMember(userId string, groupId string, memberId string) (*models.Group, error) {
+	if memberId == userId {
+		return g.Leave(userId, groupId)
+	}
+	group, err := g.memberGroup(userId, groupId, ActionRemoveMember, memberId)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsMember(memberId) {
+		return nil, ErrNotGroupMember
+	}
+	now := time.Now().UnixMilli()
+	if err = group.RemoveMember(g.Mongo, memberId, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoMemberRemoved,
+		UserId:    userId,
+		TargetIds: []string{memberId},
+		Message:   "Member removed",
+		Timestamp: now,
+	})
+	return group, nil
+}
+
+// Leave removes the user from the group, the owner has to transfer the ownership first
+func (g *Group) Leave(userId string, groupId string) (*models.Group, error) {
+	group, err := g.memberGroup(userId, groupId, ActionManageMembers, "")
+	if err != nil {
+		return nil, err
+	}
+	if group.IsOwner(userId) && len(group.MemberIds) > 1 {
+		return nil, ErrOwnerCannotLeave
+	}
+	now := time.Now().UnixMilli()
+	if err = group.RemoveMember(g.Mongo, userId, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoMemberLeft,
+		UserId:    userId,
+		Message:   "Member left",
+		Timestamp: now,
+	})
+	return group, nil
+}
+
+// PromoteAdmin makes a member admin, only admins can promote
+func (g *Group) PromoteAdmin(userId string, groupId string, memberId string) (*models.Group, error) {
+	group, err := g.memberGroup(userId, groupId, ActionPromoteAdmin, memberId)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsMember(memberId) {
+		return nil, ErrNotGroupMember
+	}
+	if group.IsAdmin(memberId) {
+		return group, nil
+	}
+	now := time.Now().UnixMilli()
+	if err = group.AddAdmin(g.Mongo, memberId, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoAdminPromoted,
+		UserId:    userId,
+		TargetIds: []string{memberId},
+		Message:   "Admin promoted",
+		Timestamp: now,
+	})
+	return group, nil
+}
+
+// DemoteAdmin revokes the admin role of a member, only the owner can demote and cannot demote themselves
+func (g *Group) DemoteAdmin(userId string, groupId string, memberId string) (*models.Group, error) {
+	group, err := g.memberGroup(userId, groupId, ActionDemoteAdmin, memberId)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsAdmin(memberId) {
+		return group, nil
+	}
+	now := time.Now().UnixMilli()
+	if err = group.RemoveAdmin(g.Mongo, memberId, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoAdminDemoted,
+		UserId:    userId,
+		TargetIds: []string{memberId},
+		Message:   "Admin demoted",
+		Timestamp: now,
+	})
+	return group, nil
+}
+
+// TransferOwnership hands the group over to another member, only the owner can transfer
+func (g *Group) TransferOwnership(userId string, groupId string, memberId string) (*models.Group, error) {
+	group, err := g.memberGroup(userId, groupId, ActionTransferOwner, memberId)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsMember(memberId) {
+		return nil, ErrNotGroupMember
+	}
+	if memberId == userId {
+		return group, nil
+	}
+	now := time.Now().UnixMilli()
+	if err = group.TransferOwnership(g.Mongo, memberId, now); err != nil {
+		return nil, err
+	}
+	g.ChatCtl.postInfo(groupAccess(group), &models.ChatInfo{
+		Type:      models.ChatInfoOwnerTransferred,
+		UserId:    userId,
+		TargetIds: []string{memberId},
+		Message:   "Ownership transferred",
+		Timestamp: now,
+	})
+	return group, nil
+}
+
+// processMemberMessage handles the membership websocket messages
+func (g *Group) processMemberMessage(cl *ChatClient, msgType string, msg *WsGroupMemberMsg) error {
+	var err error
+	switch msgType {
+	case "add_members":
+		_, err = g.AddMembers(cl.UserId, msg.GroupId, msg.UserIds)
+	case "remove_member":
+		_, err = g.RemoveMember(cl.UserId, msg.GroupId, msg.UserId)
+	case "leave_group":
+		_, err = g.Leave(cl.UserId, msg.GroupId)
+	case "promote_admin":
+		_, err = g.PromoteAdmin(cl.UserId, msg.GroupId, msg.UserId)
+	case "demote_admin":
+		_, err = g.DemoteAdmin(cl.UserId, msg.GroupId, msg.UserId)
+	case "transfer_ownership":
+		_, err = g.TransferOwnership(cl.UserId, msg.GroupId, msg.UserId)
+	default:
+		return ErrMessageTypeUnknown
+	}
+	// The change reaches every member, the caller included, as an info chat
+	return err
+}
+
+// respondGroupError writes the error response for errors of group operations
+func respondGroupError(c *gin.Context, err error) {
+	if errors.Is(err, ErrAccessDenied) {
+		c.JSON(403, &schema.ErrorResponse{
+			Code:    schema.ErrPermissionDenied,
+			Message: err.Error(),
+		})
+		return
+	}
+	switch err {
+	case ErrNotGroupMember, ErrAlreadyGroupMember, ErrOwnerCannotLeave, ErrMemberNotFound, ErrInvalidAvatar,
+		models.ErrJoinRequestPending:
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: err.Error(),
+		})
+	case ErrChatNotFound:
+		c.JSON(404, &schema.ErrorResponse{
+			Code:    schema.ErrResourceNotFound,
+			Message: "Group not found",
+		})
+	case models.ErrInviteInvalid, models.ErrJoinRequestNotFound:
+		c.JSON(404, &schema.ErrorResponse{
+			Code:    schema.ErrResourceNotFound,
+			Message: err.Error(),
+		})
+	default:
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+	}
+}
+
+// respondGroup writes the updated group, or the error of the operation
+func (g *Group) respondGroup(c *gin.Context, group *models.Group, err error) {
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	g.signAvatar(group)
+	c.JSON(200, group)
+}
+
+func (g *Group) PostMembers(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var req MembersRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrUnparsableJSON,
+			Message: "Unparsable request",
+		})
+		return
+	}
+	if len(req.UserIds) == 0 {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldRequired,
+			Message: "User ids are required",
+		})
+		return
+	}
+	group, err := g.AddMembers(userId, c.Param("id"), req.UserIds)
+	g.respondGroup(c, group, err)
+}
+
+func (g *Group) DeleteMember(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.RemoveMember(userId, c.Param("id"), c.Param("userId"))
+	g.respondGroup(c, group, err)
+}
+
+func (g *Group) PostLeave(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.Leave(userId, c.Param("id"))
+	g.respondGroup(c, group, err)
+}
+
+func (g *Group) PostAdmin(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.PromoteAdmin(userId, c.Param("id"), c.Param("userId"))
+	g.respondGroup(c, group, err)
+}
+
+func (g *Group) DeleteAdmin(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	group, err := g.DemoteAdmin(userId, c.Param("id"), c.Param("userId"))
+	g.respondGroup(c, group, err)
+}
+
+func (g *Group) PutOwner(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var req TransferOwnershipRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrUnparsableJSON,
+			Message: "Unparsable request",
+		})
+		return
+	}
+	if req.UserId == "" {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldRequired,
+			Message: "User id is required",
+		})
+		return
+	}
+	group, err := g.TransferOwnership(userId, c.Param("id"), req.UserId)
+	g.respondGroup(c, group, err)
+}
@@ -0,0 +1,64 @@
+package controllers
+
+// WsHub is the set of channels websocket handlers use to talk to the
+// websocket manager. The manager blocks on these channels in its run loop.
+type WsHub struct {
+	Register   chan *ChatClient
+	Unregister chan *ChatClient
+	Broadcast  chan *WsBroadcast
+	// Done is closed by the manager when it stops, so senders never block forever
+	Done chan struct{}
+	// Sessions is the registry of live sessions maintained by the manager
+	Sessions *SessionRegistry
+}
+
+// WsBroadcast is a message to be delivered to every session of the given users
+type WsBroadcast struct {
+	UserIds []string
+	Message *WsBaseMessage
+	// ExceptClientId skips one session, e.g. the one the message originated from
+	ExceptClientId string
+}
+
+func NewWsHub() *WsHub {
+	return &WsHub{
+		Register:   make(chan *ChatClient),
+		Unregister: make(chan *ChatClient),
+		Broadcast:  make(chan *WsBroadcast, 256),
+		Done:       make(chan struct{}),
+		Sessions:   NewSessionRegistry(),
+	}
+}
+
+func (h *WsHub) register(cl *ChatClient) {
+	select {
+	case h.Register <- cl:
+	case <-h.Done:
+	}
+}
+
+func (h *WsHub) unregister(cl *ChatClient) {
+	select {
+	case h.Unregister <- cl:
+	case <-h.Done:
+	}
+}
+
+func (h *WsHub) broadcast(msg *WsBaseMessage, userIds ...string) {
+	h.send(&WsBroadcast{UserIds: userIds, Message: msg})
+}
+
+// broadcastToOtherSessions sends msg to every session of cl's user except cl itself
+func (h *WsHub) broadcastToOtherSessions(cl *ChatClient, msg *WsBaseMessage) {
+	h.send(&WsBroadcast{UserIds: []string{cl.UserId}, Message: msg, ExceptClientId: cl.Id})
+}
+
+func (h *WsHub) send(b *WsBroadcast) {
+	if len(b.UserIds) == 0 {
+		return
+	}
+	select {
+	case h.Broadcast <- b:
+	case <-h.Done:
+	}
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+	"github.com/krissukoco/go-gin-chat/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DefaultMediaMaxSize   int64 = 10 << 20
+	DefaultMediaUrlExpiry       = 15 * time.Minute
+	MaxChatMedia                = 10
+)
+
+var (
+	ErrMediaInvalid = errors.New("invalid media")
+
+	// AllowedMediaTypes are the MIME types accepted for upload, detected from the content
+	AllowedMediaTypes = map[string]bool{
+		"image/jpeg":      true,
+		"image/png":       true,
+		"image/gif":       true,
+		"image/webp":      true,
+		"application/pdf": true,
+		"application/zip": true,
+		"text/plain":      true,
+	}
+)
+
+type Media struct {
+	Mongo   *mongo.Database
+	Store   storage.BlobStore
+	ChatCtl *Chat // bridge to chat controller to check access to conversations
+	// MaxSize is the maximum upload size in bytes
+	MaxSize int64
+	// UrlExpiry is how long signed download urls are valid
+	UrlExpiry time.Duration
+	// Processor generates thumbnails and metadata of uploaded images
+	Processor *MediaProcessor
+}
+
+// signUrl sets the signed download urls of the media and its thumbnails
+func (m *Media) signUrl(ctx context.Context, media *models.Media) error {
+	return signMediaUrls(ctx, m.Store, media, m.UrlExpiry)
+}
+
+// detectMimeType sniffs the MIME type from the content, ignoring the client supplied header
+func detectMimeType(r io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return mimeType, err
+}
+
+func (m *Media) Upload(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	// Leave room for the multipart envelope
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, m.MaxSize+(1<<20))
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldRequired,
+			Message: "file is required",
+		})
+		return
+	}
+	if fileHeader.Size > m.MaxSize {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFileTooLarge,
+			Message: "File must be at most " + strconv.FormatInt(m.MaxSize, 10) + " bytes",
+		})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	defer file.Close()
+	mimeType, err := detectMimeType(file)
+	if err != nil || !AllowedMediaTypes[mimeType] {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFileTypeNotAllowed,
+			Message: "File type is not allowed",
+		})
+		return
+	}
+
+	objId := primitive.NewObjectID()
+	media := &models.Media{
+		ObjectId:  objId,
+		OwnerId:   userId,
+		Key:       "media/" + objId.Hex(),
+		FileName:  filepath.Base(fileHeader.Filename),
+		MimeType:  mimeType,
+		Size:      fileHeader.Size,
+		CreatedAt: time.Now().UnixMilli(),
+		Status:    models.MediaStatusReady,
+	}
+	if isProcessable(media) {
+		media.Status = models.MediaStatusProcessing
+	}
+	ctx := c.Request.Context()
+	if err = m.Store.Put(ctx, media.Key, file, media.Size, mimeType); err != nil {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	if err = media.Save(m.Mongo); err != nil {
+		m.Store.Delete(ctx, media.Key)
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	if media.Status == models.MediaStatusProcessing {
+		// 'media_ready' is sent over websocket once done
+		m.Processor.Enqueue(media)
+	}
+	if err = m.signUrl(ctx, media); err != nil {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	c.JSON(200, media)
+}
+
+// canAccess tells whether the user owns the media or can read a conversation it was sent to
+func (m *Media) canAccess(userId string, media *models.Media) bool {
+	if media.OwnerId == userId {
+		return true
+	}
+	chatIds, _, err := m.ChatCtl.userChatIds(userId)
+	if err != nil {
+		return false
+	}
+	var c models.Chat
+	if c.FindByMediaId(m.Mongo, media.ObjectId.Hex(), chatIds) == nil {
+		return true
+	}
+	isAvatar, err := models.IsMemberGroupAvatar(m.Mongo, media.ObjectId.Hex(), userId)
+	return err == nil && isAvatar
+}
+
+// GetById returns the media with a freshly signed download url
+func (m *Media) GetById(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var media models.Media
+	if err := media.FindById(m.Mongo, c.Param("id")); err != nil || !m.canAccess(userId, &media) {
+		c.JSON(404, &schema.ErrorResponse{
+			Code:    schema.ErrResourceNotFound,
+			Message: "Media not found",
+		})
+		return
+	}
+	if err := m.signUrl(c.Request.Context(), &media); err != nil {
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	c.JSON(200, &media)
+}
+
+// ServeLocalBlob serves blobs of the local store behind signed urls
+func (m *Media) ServeLocalBlob(local *storage.Local) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || !local.Verify(key, expires, c.Query("signature")) {
+			c.JSON(403, &schema.ErrorResponse{
+				Code:    schema.ErrTokenInvalid,
+				Message: "Invalid or expired signature",
+			})
+			return
+		}
+		var media models.Media
+		if err := media.FindByKey(m.Mongo, key); err != nil || (key == media.Key && !media.IsReady()) {
+			c.JSON(404, &schema.ErrorResponse{
+				Code:    schema.ErrResourceNotFound,
+				Message: "Media not found",
+			})
+			return
+		}
+		blob, err := local.Get(c.Request.Context(), key)
+		if err != nil {
+			c.JSON(404, &schema.ErrorResponse{
+				Code:    schema.ErrResourceNotFound,
+				Message: "Media not found",
+			})
+			return
+		}
+		defer blob.Close()
+		size, mimeType, fileName := media.Size, media.MimeType, media.FileName
+		if thumb := media.Thumbnail(key); thumb != nil {
+			size, mimeType = thumb.ByteSize, thumb.MimeType
+			fileName = fmt.Sprintf("thumb_%d_%s.jpg", thumb.Size, strings.TrimSuffix(media.FileName, filepath.Ext(media.FileName)))
+		}
+		c.DataFromReader(200, size, mimeType, blob, map[string]string{
+			"Content-Disposition": mime.FormatMediaType("inline", map[string]string{"filename": fileName}),
+		})
+	}
+}
+
+// attachMedia validates media ids of an image or file chat, they must be uploaded by the sender
+func (chat *Chat) attachMedia(chatModel *models.Chat, mediaIds []string) error {
+	if len(mediaIds) == 0 || len(mediaIds) > MaxChatMedia {
+		return ErrMediaInvalid
+	}
+	media, err := models.GetOwnedMedia(chat.Mongo, chatModel.SenderId, mediaIds)
+	if err != nil {
+		return ErrMediaInvalid
+	}
+	urls := make([]string, 0, len(media))
+	for _, md := range media {
+		if chatModel.Type == models.ChatTypeImage && !strings.HasPrefix(md.MimeType, "image/") {
+			return ErrMediaInvalid
+		}
+		urls = append(urls, "/media/"+md.ObjectId.Hex())
+	}
+	chatModel.MediaIds = mediaIds
+	chatModel.MediaUrls = urls
+	return nil
+}
@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krissukoco/go-gin-chat/imaging"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// MaxImagePixels guards the pipeline against decompression bombs,
+	// for animated gifs it bounds the pixels of all frames together
+	MaxImagePixels = 50_000_000
+	// MaxGifFrames is the most frames an animated gif may have
+	MaxGifFrames = 500
+	// DefaultRescanInterval is how often media left processing are queued again,
+	// e.g. after a restart or when the queue was full
+	DefaultRescanInterval = time.Minute
+)
+
+var (
+	// DefaultThumbnailSizes are the maximum side lengths of generated thumbnails
+	DefaultThumbnailSizes = []int{160, 320, 640}
+
+	ErrImageTooLarge = errors.New("image dimensions are too large")
+)
+
+// MediaProcessor generates thumbnails and extracts metadata of uploaded images in the background
+type MediaProcessor struct {
+	Mongo     *mongo.Database
+	Store     storage.BlobStore
+	Hub       *WsHub
+	Sizes     []int
+	UrlExpiry time.Duration
+	// RescanInterval is how often media stuck processing are queued again
+	RescanInterval time.Duration
+	jobs           chan string
+	mu             sync.Mutex
+	// queued are the media ids in the queue or being processed on this node
+	queued map[string]bool
+}
+
+func NewMediaProcessor(db *mongo.Database, store storage.BlobStore, hub *WsHub, queueSize int) *MediaProcessor {
+	return &MediaProcessor{
+		Mongo:          db,
+		Store:          store,
+		Hub:            hub,
+		Sizes:          DefaultThumbnailSizes,
+		UrlExpiry:      DefaultMediaUrlExpiry,
+		RescanInterval: DefaultRescanInterval,
+		jobs:           make(chan string, queueSize),
+		queued:         make(map[string]bool),
+	}
+}
+
+// Start runs the given number of workers and the rescan of media left processing
+func (p *MediaProcessor) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range p.jobs {
+				p.process(id)
+				p.mu.Lock()
+				delete(p.queued, id)
+				p.mu.Unlock()
+			}
+		}()
+	}
+	go p.rescan()
+}
+
+// Enqueue schedules processing of the media without blocking. If the queue is full
+// the media stays processing and is picked up by the next rescan. Returns false in that case.
+func (p *MediaProcessor) Enqueue(media *models.Media) bool {
+	id := media.ObjectId.Hex()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued[id] {
+		return true
+	}
+	select {
+	case p.jobs <- id:
+		p.queued[id] = true
+		return true
+	default:
+		log.Println("Media processing queue is full, deferring media: ", id)
+		return false
+	}
+}
+
+// rescan queues media still processing since before the last interval, right away then periodically.
+// Only stale media are picked so media just uploaded to another node are left to that node.
+func (p *MediaProcessor) rescan() {
+	ticker := time.NewTicker(p.RescanInterval)
+	defer ticker.Stop()
+	for {
+		before := time.Now().Add(-p.RescanInterval).UnixMilli()
+		media, err := models.GetStaleProcessingMedia(p.Mongo, before, cap(p.jobs))
+		if err != nil {
+			log.Println("ERROR finding media to process: ", err)
+		}
+		for _, md := range media {
+			if !p.Enqueue(md) {
+				break
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// isProcessable tells whether the media goes through the pipeline
+func isProcessable(media *models.Media) bool {
+	return strings.HasPrefix(media.MimeType, "image/")
+}
+
+func (p *MediaProcessor) process(id string) {
+	ctx := context.Background()
+	var media models.Media
+	if err := media.FindById(p.Mongo, id); err != nil {
+		log.Println("ERROR finding media to process: ", err)
+		return
+	}
+	if media.Status != models.MediaStatusProcessing {
+		// Already processed, e.g. by another node
+		return
+	}
+	if err := p.processImage(ctx, &media); err != nil {
+		log.Println("ERROR processing media: ", err)
+		media.Status = models.MediaStatusFailed
+	} else {
+		media.Status = models.MediaStatusReady
+	}
+	if err := media.Save(p.Mongo); err != nil {
+		log.Println("ERROR saving processed media: ", err)
+		return
+	}
+	if err := signMediaUrls(ctx, p.Store, &media, p.UrlExpiry); err != nil {
+		log.Println("ERROR signing media urls: ", err)
+	}
+	p.Hub.broadcast(&WsBaseMessage{
+		Type: "media_ready",
+		Data: &media,
+	}, p.mediaRecipients(&media)...)
+}
+
+// mediaRecipients returns the uploader and the participants of every conversation
+// with a chat referencing the media, who may have received it while processing
+func (p *MediaProcessor) mediaRecipients(media *models.Media) []string {
+	recipients := []string{media.OwnerId}
+	chatIds, err := models.GetMediaChatIds(p.Mongo, media.ObjectId.Hex())
+	if err != nil {
+		log.Println("ERROR finding chats of media: ", err)
+		return recipients
+	}
+	lists := [][]string{recipients}
+	for _, chatId := range chatIds {
+		participants, err := conversationParticipants(p.Mongo, chatId)
+		if err != nil {
+			log.Println("ERROR finding participants of media chat: ", err)
+			continue
+		}
+		lists = append(lists, participants)
+	}
+	return union(lists...)
+}
+
+// processImage strips metadata of the original, then records dimensions, thumbnails and blurhash
+func (p *MediaProcessor) processImage(ctx context.Context, media *models.Media) error {
+	blob, err := p.Store.Get(ctx, media.Key)
+	if err != nil {
+		return err
+	}
+	original, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return ErrImageTooLarge
+	}
+	if format == "gif" {
+		// The config only describes the first frame, every frame is decoded when stripping
+		frames, pixels, err := imaging.GifFrames(original)
+		if err != nil {
+			return err
+		}
+		if frames > MaxGifFrames || pixels > MaxImagePixels {
+			return ErrImageTooLarge
+		}
+	}
+	img, format, err := imaging.Decode(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+	media.Width = img.Bounds().Dx()
+	media.Height = img.Bounds().Dy()
+
+	// Replace the original with a copy without EXIF data (location, camera...)
+	stripped, mimeType, err := imaging.Strip(original, img, format)
+	if err != nil {
+		return err
+	}
+	if err = p.Store.Put(ctx, media.Key, bytes.NewReader(stripped), int64(len(stripped)), mimeType); err != nil {
+		return err
+	}
+	if mimeType != media.MimeType {
+		// Converted, e.g. webp to png
+		if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+			media.FileName = strings.TrimSuffix(media.FileName, filepath.Ext(media.FileName)) + exts[0]
+		}
+		media.MimeType = mimeType
+	}
+	media.Size = int64(len(stripped))
+
+	thumbnails := make([]*models.MediaThumbnail, 0, len(p.Sizes))
+	for _, size := range p.Sizes {
+		thumb := imaging.Resize(img, size)
+		b, err := imaging.EncodeJpeg(thumb)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s_thumb_%d", media.Key, size)
+		if err = p.Store.Put(ctx, key, bytes.NewReader(b), int64(len(b)), "image/jpeg"); err != nil {
+			return err
+		}
+		thumbnails = append(thumbnails, &models.MediaThumbnail{
+			Size:     size,
+			Key:      key,
+			Width:    thumb.Bounds().Dx(),
+			Height:   thumb.Bounds().Dy(),
+			ByteSize: int64(len(b)),
+			MimeType: "image/jpeg",
+		})
+	}
+	media.Thumbnails = thumbnails
+
+	media.Blurhash, err = imaging.Blurhash(img)
+	return err
+}
+
+// signMediaUrls sets the signed download urls of the media and its thumbnails.
+// The original is not signed until processing has stripped its metadata.
+func signMediaUrls(ctx context.Context, store storage.BlobStore, media *models.Media, expiry time.Duration) error {
+	var err error
+	if media.IsReady() {
+		if media.Url, err = store.SignedURL(ctx, media.Key, expiry); err != nil {
+			return err
+		}
+	}
+	for _, thumb := range media.Thumbnails {
+		if thumb.Url, err = store.SignedURL(ctx, thumb.Key, expiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
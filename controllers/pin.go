@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+)
+
+const (
+	// DefaultMaxPins is the default limit of pinned chats per conversation
+	DefaultMaxPins = 5
+)
+
+// WsPinMsg is the data of 'pin_chat' and 'unpin_chat'
+type WsPinMsg struct {
+	ChatId    string `json:"chat_id"`
+	MessageId string `json:"message_id"`
+}
+
+// WsPinData is the data of 'chat_pinned' and 'chat_unpinned'
+type WsPinData struct {
+	ChatId    string       `json:"chat_id"`
+	MessageId string       `json:"message_id"`
+	Chat      *models.Chat `json:"chat"`
+}
+
+// Pin pins or unpins a chat of the conversation, group admins and both direct conversation
+// participants can pin. Writes an info chat and notifies every participant.
+func (chat *Chat) Pin(userId string, chatId string, messageId string, pin bool) (*models.Chat, error) {
+	chatId, err := chat.resolveChatId(userId, chatId, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	access, err := chat.Access.Authorize(userId, chatId, ActionPin)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	var c *models.Chat
+	info := &models.ChatInfo{
+		UserId:    userId,
+		MessageId: messageId,
+		Timestamp: now,
+	}
+	event := "chat_pinned"
+	if pin {
+		c, err = models.PinChat(chat.Mongo, access.ChatId, messageId, userId, chat.MaxPins, now)
+		info.Type = models.ChatInfoChatPinned
+		info.Message = "Message pinned"
+	} else {
+		c, err = models.UnpinChat(chat.Mongo, access.ChatId, messageId)
+		info.Type = models.ChatInfoChatUnpinned
+		info.Message = "Message unpinned"
+		event = "chat_unpinned"
+	}
+	if err != nil {
+		return nil, err
+	}
+	participants := access.Participants()
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: event,
+		Data: &WsPinData{ChatId: access.ChatId, MessageId: messageId, Chat: c},
+	}, participants...)
+	chat.postInfo(access, info)
+	return c, nil
+}
+
+// postInfo writes an info chat into the conversation timeline and sends it to every participant,
+// and to the users the change was about, who may have just been removed or left. Failures are
+// logged only, the change itself has already been saved.
+func (chat *Chat) postInfo(access *ChatAccess, info *models.ChatInfo) {
+	if info.Timestamp == 0 {
+		info.Timestamp = time.Now().UnixMilli()
+	}
+	chatModel := models.NewInfoChat(access.ChatId, info)
+	if err := chatModel.Save(chat.Mongo); err != nil {
+		log.Println("ERROR saving info chat: ", err)
+		return
+	}
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: "new_chat",
+		Data: &WsChatData{Chat: chatModel, Group: access.Group, Conversation: access.Conversation},
+	}, union(access.Participants(), info.TargetIds, []string{info.UserId})...)
+}
+
+// GetPins returns the pinned chats of a conversation the user can read
+func (chat *Chat) GetPins(userId string, chatId string) ([]*models.Chat, error) {
+	chatId, err := chat.resolveChatId(userId, chatId, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	return models.GetPinnedChats(chat.Mongo, chatId)
+}
+
+func (chat *Chat) GetConversationPins(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	pins, err := chat.GetPins(userId, c.Param("id"))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.JSON(200, pins)
+}
+
+func (chat *Chat) PostConversationPin(c *gin.Context) {
+	chat.pinConversationChat(c, true)
+}
+
+func (chat *Chat) DeleteConversationPin(c *gin.Context) {
+	chat.pinConversationChat(c, false)
+}
+
+func (chat *Chat) pinConversationChat(c *gin.Context, pin bool) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	pinned, err := chat.Pin(userId, c.Param("id"), c.Param("messageId"), pin)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.JSON(200, pinned)
+}
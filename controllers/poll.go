@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/krissukoco/go-gin-chat/models"
+)
+
+const (
+	MaxPollOptions = 12
+)
+
+var (
+	ErrInvalidPollOption = errors.New("invalid poll option")
+	ErrNotPollCreator    = errors.New("only the poll creator can close it")
+)
+
+type WsPollMsg struct {
+	Question       string   `json:"question"`
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multiple_choice"`
+}
+
+type WsVotePollMsg struct {
+	MessageId string `json:"message_id"`
+	// OptionIndexes are the chosen options, empty to retract every vote
+	OptionIndexes []int `json:"option_indexes"`
+}
+
+type WsClosePollMsg struct {
+	MessageId string `json:"message_id"`
+}
+
+type WsPollData struct {
+	ChatId    string       `json:"chat_id"`
+	MessageId string       `json:"message_id"`
+	Poll      *models.Poll `json:"poll"`
+}
+
+// toPoll validates the poll of a 'send_chat' message
+func (p *WsPollMsg) toPoll() (*models.Poll, error) {
+	if p == nil || strings.TrimSpace(p.Question) == "" {
+		return nil, ErrInvalidSchema
+	}
+	if len(p.Options) < 2 || len(p.Options) > MaxPollOptions {
+		return nil, ErrInvalidSchema
+	}
+	poll := &models.Poll{
+		Question:       p.Question,
+		Options:        make([]*models.PollOption, 0, len(p.Options)),
+		MultipleChoice: p.MultipleChoice,
+	}
+	for _, text := range p.Options {
+		if strings.TrimSpace(text) == "" {
+			return nil, ErrInvalidSchema
+		}
+		poll.Options = append(poll.Options, &models.PollOption{
+			Text:      text,
+			UserVotes: make([]string, 0),
+		})
+	}
+	return poll, nil
+}
+
+// findPoll returns the poll chat if the user can access its conversation
+func (chat *Chat) findPoll(userId string, messageId string) (*models.Chat, error) {
+	var c models.Chat
+	if err := c.FindByMessageId(chat.Mongo, messageId); err != nil || c.Type != models.ChatTypePoll || c.Poll == nil {
+		return nil, models.ErrPollNotFound
+	}
+	if _, err := chat.resolveChatId(userId, c.ChatId, ActionVote); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// VotePoll sets the user's votes on a poll, an empty list retracts them
+func (chat *Chat) VotePoll(userId string, messageId string, optionIndexes []int) error {
+	c, err := chat.findPoll(userId, messageId)
+	if err != nil {
+		return err
+	}
+	if !c.Poll.MultipleChoice && len(optionIndexes) > 1 {
+		return ErrInvalidPollOption
+	}
+	for _, i := range optionIndexes {
+		if i < 0 || i >= len(c.Poll.Options) {
+			return ErrInvalidPollOption
+		}
+	}
+	updated, err := models.VotePoll(chat.Mongo, messageId, userId, optionIndexes)
+	if err != nil {
+		return err
+	}
+	return chat.broadcastPoll(updated)
+}
+
+// ClosePoll closes the poll, only its creator can close it
+func (chat *Chat) ClosePoll(userId string, messageId string) error {
+	c, err := chat.findPoll(userId, messageId)
+	if err != nil {
+		return err
+	}
+	if c.SenderId != userId {
+		return ErrNotPollCreator
+	}
+	updated, err := models.ClosePoll(chat.Mongo, messageId, userId, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	return chat.broadcastPoll(updated)
+}
+
+// broadcastPoll sends the live tally to every participant of the poll's conversation
+func (chat *Chat) broadcastPoll(c *models.Chat) error {
+	participants, err := chat.chatParticipants(c.ChatId)
+	if err != nil {
+		return err
+	}
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: "poll_updated",
+		Data: &WsPollData{
+			ChatId:    c.ChatId,
+			MessageId: c.ObjectId.Hex(),
+			Poll:      c.Poll,
+		},
+	}, participants...)
+	return nil
+}
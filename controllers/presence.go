@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+)
+
+const (
+	// PresenceTTL is how long a session counts as live without a heartbeat
+	PresenceTTL = 90 * time.Second
+	// PresenceHeartbeat is how often the live sessions of a node are refreshed
+	PresenceHeartbeat = 30 * time.Second
+)
+
+type PresenceData struct {
+	UserId string `json:"user_id"`
+	Online bool   `json:"online"`
+	// LastSeen is omitted when the user hides it
+	LastSeen int64 `json:"last_seen,omitempty"`
+}
+
+// connect registers an authenticated client and marks the user online. Online is sent for every
+// new session since concurrent connects cannot tell which one is the first, clients de-duplicate it.
+func (chat *Chat) connect(cl *ChatClient) {
+	chat.Hub.register(cl)
+	if err := models.StartPresenceSession(chat.Mongo, cl.Id, cl.UserId, time.Now(), PresenceTTL); err != nil {
+		log.Println("ERROR updating presence: ", err)
+		return
+	}
+	go chat.presenceHeartbeat(cl)
+	chat.broadcastPresence(&PresenceData{
+		UserId: cl.UserId,
+		Online: true,
+	})
+}
+
+// disconnect unregisters a client and marks the user offline when their last session leaves
+func (chat *Chat) disconnect(cl *ChatClient) {
+	chat.Hub.unregister(cl)
+	now := time.Now()
+	sessions, err := models.EndPresenceSession(chat.Mongo, cl.Id, cl.UserId, now)
+	if err != nil {
+		log.Println("ERROR updating presence: ", err)
+		return
+	}
+	if sessions > 0 {
+		return
+	}
+	user, err := chat.UserCtl.GetUserById(cl.UserId)
+	if err != nil {
+		log.Println("ERROR finding user: ", err)
+		return
+	}
+	if err = user.UpdateLastSeen(chat.UserCtl.Pg, now.UnixMilli()); err != nil {
+		log.Println("ERROR updating last seen: ", err)
+	}
+	data := &PresenceData{
+		UserId: cl.UserId,
+		Online: false,
+	}
+	if !user.HideLastSeen {
+		data.LastSeen = now.UnixMilli()
+	}
+	chat.broadcastPresence(data)
+}
+
+// presenceHeartbeat keeps the client's presence session live until the connection is closed
+func (chat *Chat) presenceHeartbeat(cl *ChatClient) {
+	ticker := time.NewTicker(PresenceHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cl.closed:
+			return
+		case now := <-ticker.C:
+			if err := models.RefreshPresenceSession(chat.Mongo, cl.Id, now, PresenceTTL); err != nil {
+				log.Println("ERROR refreshing presence: ", err)
+			}
+		}
+	}
+}
+
+// contactIds returns every user sharing a group or direct conversation with the user
+func (chat *Chat) contactIds(userId string) ([]string, error) {
+	groups, err := models.GetUserGroups(chat.Mongo, userId)
+	if err != nil {
+		return nil, err
+	}
+	convs, err := models.GetUserConversations(chat.Mongo, userId)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{userId: true}
+	ids := make([]string, 0)
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, g := range groups {
+		for _, id := range g.MemberIds {
+			add(id)
+		}
+	}
+	for _, conv := range convs {
+		add(conv.PeerId(userId))
+	}
+	return ids, nil
+}
+
+func (chat *Chat) broadcastPresence(data *PresenceData) {
+	contacts, err := chat.contactIds(data.UserId)
+	if err != nil {
+		log.Println("ERROR finding contacts: ", err)
+		return
+	}
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: "presence",
+		Data: data,
+	}, contacts...)
+}
+
+// GetPresence returns whether the user is online and when they were last seen.
+// Only users sharing a conversation with the caller are visible, others are not found.
+func (chat *Chat) GetPresence(callerId string, userId string) (*PresenceData, error) {
+	if callerId != userId {
+		shared, err := models.SharesConversation(chat.Mongo, callerId, userId)
+		if err != nil {
+			return nil, err
+		}
+		if !shared {
+			return nil, models.ErrUserNotFound
+		}
+	}
+	user, err := chat.UserCtl.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	online, err := models.IsOnline(chat.Mongo, userId)
+	if err != nil {
+		return nil, err
+	}
+	data := &PresenceData{
+		UserId: userId,
+		Online: online,
+	}
+	if !user.HideLastSeen && !online {
+		data.LastSeen = user.LastSeen
+	}
+	return data, nil
+}
+
+func (chat *Chat) GetUserPresence(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	presence, err := chat.GetPresence(userId, c.Param("id"))
+	if err != nil {
+		if err == models.ErrUserNotFound {
+			c.JSON(404, &schema.ErrorResponse{
+				Code:    schema.ErrResourceNotFound,
+				Message: "user not found",
+			})
+			return
+		}
+		c.JSON(500, &schema.ErrorResponse{
+			Code:    schema.ErrInternalServer,
+			Message: "Internal server error",
+		})
+		return
+	}
+	c.JSON(200, presence)
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/krissukoco/go-gin-chat/models"
+)
+
+const (
+	// DefaultMaxReactions is the default limit of distinct emojis on one chat
+	DefaultMaxReactions = 20
+	// MaxEmojiLength is in bytes, enough for emojis made of several code points
+	MaxEmojiLength = 32
+)
+
+var (
+	ErrInvalidReaction = errors.New("invalid reaction")
+)
+
+// ReactionConfig restricts the reactions users can add
+type ReactionConfig struct {
+	// Allowed is the allowlist of emojis, empty allows any emoji
+	Allowed []string
+	// MaxPerChat is the limit of distinct emojis on one chat, zero for no limit
+	MaxPerChat int
+}
+
+func DefaultReactionConfig() ReactionConfig {
+	return ReactionConfig{
+		MaxPerChat: DefaultMaxReactions,
+	}
+}
+
+// WsReactMsg is the data of 'react' and 'unreact'
+type WsReactMsg struct {
+	MessageId string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// WsReactionData is the data of 'reaction_updated'
+type WsReactionData struct {
+	ChatId    string              `json:"chat_id"`
+	MessageId string              `json:"message_id"`
+	Reactions map[string][]string `json:"reactions"`
+}
+
+// validEmoji checks the emoji is allowed and safe to use as a document key
+func (config *ReactionConfig) validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > MaxEmojiLength || strings.ContainsAny(emoji, ".$") {
+		return false
+	}
+	if len(config.Allowed) == 0 {
+		return true
+	}
+	for _, allowed := range config.Allowed {
+		if allowed == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// React adds or removes the user's reaction with emoji on a chat and
+// sends the updated reactions to every participant
+func (chat *Chat) React(userId string, messageId string, emoji string, add bool) error {
+	if !chat.ReactionConfig.validEmoji(emoji) {
+		return ErrInvalidReaction
+	}
+	c, err := chat.findChatMessage(userId, "", messageId, ActionRead)
+	if err != nil {
+		return err
+	}
+	var updated *models.Chat
+	if add {
+		updated, err = models.ReactChat(chat.Mongo, messageId, userId, emoji, chat.ReactionConfig.MaxPerChat)
+	} else {
+		updated, err = models.UnreactChat(chat.Mongo, messageId, userId, emoji)
+	}
+	if err != nil {
+		return err
+	}
+	reactions := updated.Reactions
+	if reactions == nil {
+		reactions = map[string][]string{}
+	}
+	participants, err := chat.chatParticipants(c.ChatId)
+	if err != nil {
+		return err
+	}
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: "reaction_updated",
+		Data: &WsReactionData{
+			ChatId:    c.ChatId,
+			MessageId: messageId,
+			Reactions: reactions,
+		},
+	}, participants...)
+	return nil
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+)
+
+type WsMarkMsg struct {
+	ChatId string `json:"chat_id"`
+	// UpTo is the id of the newest chat being acknowledged, every chat if empty
+	UpTo string `json:"up_to"`
+}
+
+type WsReceiptData struct {
+	ChatId     string   `json:"chat_id"`
+	UserId     string   `json:"user_id"`
+	MessageIds []string `json:"message_ids"`
+	Timestamp  int64    `json:"timestamp"`
+}
+
+// ChatReceipts is the 'read by N of M' view of a single chat
+type ChatReceipts struct {
+	MessageId      string   `json:"message_id"`
+	ReadBy         []string `json:"read_by"`
+	DeliveredTo    []string `json:"delivered_to"`
+	ReadCount      int      `json:"read_count"`
+	DeliveredCount int      `json:"delivered_count"`
+	// RecipientCount is the number of participants other than the sender
+	RecipientCount int `json:"recipient_count"`
+}
+
+// MarkChats records the client's read or delivered receipt up to a chat
+// and pushes the receipt to the senders' sessions
+func (chat *Chat) MarkChats(cl *ChatClient, chatId string, upTo string, receipt string) error {
+	chatId, err := chat.resolveChatId(cl.UserId, chatId, ActionRead)
+	if err != nil {
+		return err
+	}
+	marked, err := models.MarkChats(chat.Mongo, chatId, cl.UserId, upTo, receipt)
+	if err != nil {
+		return err
+	}
+	if len(marked) == 0 {
+		return nil
+	}
+	eventType := "read_receipt"
+	if receipt == models.ReceiptDelivered {
+		eventType = "delivery_receipt"
+	}
+	now := time.Now().UnixMilli()
+	bySender := make(map[string][]string)
+	allIds := make([]string, 0, len(marked))
+	for _, c := range marked {
+		id := c.ObjectId.Hex()
+		bySender[c.SenderId] = append(bySender[c.SenderId], id)
+		allIds = append(allIds, id)
+	}
+	for senderId, ids := range bySender {
+		chat.Hub.broadcast(&WsBaseMessage{
+			Type: eventType,
+			Data: &WsReceiptData{
+				ChatId:     chatId,
+				UserId:     cl.UserId,
+				MessageIds: ids,
+				Timestamp:  now,
+			},
+		}, senderId)
+	}
+	// Keep reader's other devices in sync, e.g. unread counts
+	if receipt == models.ReceiptRead {
+		chat.Hub.broadcastToOtherSessions(cl, &WsBaseMessage{
+			Type: eventType,
+			Data: &WsReceiptData{
+				ChatId:     chatId,
+				UserId:     cl.UserId,
+				MessageIds: allIds,
+				Timestamp:  now,
+			},
+		})
+	}
+	return nil
+}
+
+// GetReceipts returns who read and received a chat
+func (chat *Chat) GetReceipts(userId string, chatId string, messageId string) (*ChatReceipts, error) {
+	chatId, err := chat.resolveChatId(userId, chatId, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	var c models.Chat
+	if err := c.FindById(chat.Mongo, chatId, messageId); err != nil {
+		return nil, ErrChatNotFound
+	}
+	recipients := 1
+	if c.IsGroup {
+		var group models.Group
+		if err := group.FindById(chat.Mongo, chatId); err != nil {
+			return nil, err
+		}
+		recipients = len(group.MemberIds)
+		if group.IsMember(c.SenderId) {
+			recipients--
+		}
+	}
+	receipts := &ChatReceipts{
+		MessageId:      messageId,
+		ReadBy:         c.ReadBy,
+		DeliveredTo:    c.DeliveredTo,
+		ReadCount:      len(c.ReadBy),
+		DeliveredCount: len(c.DeliveredTo),
+		RecipientCount: recipients,
+	}
+	if receipts.ReadBy == nil {
+		receipts.ReadBy = make([]string, 0)
+	}
+	if receipts.DeliveredTo == nil {
+		receipts.DeliveredTo = make([]string, 0)
+	}
+	return receipts, nil
+}
+
+func (chat *Chat) GetChatReceipts(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	receipts, err := chat.GetReceipts(userId, c.Param("chatId"), c.Param("messageId"))
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.JSON(200, receipts)
+}
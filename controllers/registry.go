@@ -0,0 +1,91 @@
+package controllers
+
+import "sync"
+
+// SessionRegistry maps each user to all of their live websocket sessions on this node.
+// The websocket manager is the only writer, handlers may read it concurrently.
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]map[string]*ChatClient
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]map[string]*ChatClient),
+	}
+}
+
+// Add registers the client, returns false if it is already registered
+func (r *SessionRegistry) Add(client *ChatClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients, ok := r.sessions[client.UserId]
+	if !ok {
+		clients = make(map[string]*ChatClient)
+		r.sessions[client.UserId] = clients
+	}
+	if _, exists := clients[client.Id]; exists {
+		return false
+	}
+	clients[client.Id] = client
+	return true
+}
+
+// Remove unregisters the client, returns false if it was not registered
+func (r *SessionRegistry) Remove(client *ChatClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients, ok := r.sessions[client.UserId]
+	if !ok {
+		return false
+	}
+	if _, exists := clients[client.Id]; !exists {
+		return false
+	}
+	delete(clients, client.Id)
+	if len(clients) == 0 {
+		delete(r.sessions, client.UserId)
+	}
+	return true
+}
+
+// Clients returns every live client of the user
+func (r *SessionRegistry) Clients(userId string) []*ChatClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*ChatClient, 0, len(r.sessions[userId]))
+	for _, client := range r.sessions[userId] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Sessions returns the session info of every live client of the user
+func (r *SessionRegistry) Sessions(userId string) []*WsSession {
+	clients := r.Clients(userId)
+	sessions := make([]*WsSession, 0, len(clients))
+	for _, client := range clients {
+		sessions = append(sessions, client.Session())
+	}
+	return sessions
+}
+
+// All returns every registered client
+func (r *SessionRegistry) All() []*ChatClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*ChatClient, 0)
+	for _, userClients := range r.sessions {
+		for _, client := range userClients {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Clear removes every registered client
+func (r *SessionRegistry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions = make(map[string]map[string]*ChatClient)
+}
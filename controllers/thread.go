@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/schema"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	ErrReplyNotFound = errors.New("replied chat not found")
+)
+
+type WsGetThreadMsg struct {
+	ChatId    string `json:"chat_id"`
+	MessageId string `json:"message_id"`
+	models.ChatPageQuery
+}
+
+// WsThreadData is a page of a thread history with its root chat
+type WsThreadData struct {
+	ChatId string       `json:"chat_id"`
+	Root   *models.Chat `json:"root"`
+	*models.ChatPage
+}
+
+// WsThreadUpdateData is the data of 'thread_updated'
+type WsThreadUpdateData struct {
+	ChatId    string             `json:"chat_id"`
+	MessageId string             `json:"message_id"`
+	Thread    *models.ThreadInfo `json:"thread"`
+}
+
+// resolveReply fills the quote of the replied chat and returns the thread root if the chat is a thread reply.
+// Both must be in the chat's canonical conversation.
+func (chat *Chat) resolveReply(chatData *models.Chat) (*models.Chat, error) {
+	if chatData.ReplyTo != nil {
+		var quoted models.Chat
+		if err := quoted.FindById(chat.Mongo, chatData.ChatId, chatData.ReplyTo.MessageId); err != nil {
+			return nil, ErrReplyNotFound
+		}
+		if quoted.Deleted || quoted.Type == models.ChatTypeInfo {
+			return nil, ErrReplyNotFound
+		}
+		chatData.ReplyTo = quoted.ReplyRef()
+	}
+	if chatData.ThreadId == "" {
+		return nil, nil
+	}
+	var root models.Chat
+	if err := root.FindById(chat.Mongo, chatData.ChatId, chatData.ThreadId); err != nil {
+		return nil, ErrReplyNotFound
+	}
+	if root.ThreadId != "" {
+		// Replying to a thread reply continues its thread
+		if err := root.FindById(chat.Mongo, chatData.ChatId, root.ThreadId); err != nil {
+			return nil, ErrReplyNotFound
+		}
+	}
+	if root.Deleted || root.Type == models.ChatTypeInfo {
+		return nil, ErrReplyNotFound
+	}
+	chatData.ThreadId = root.ObjectId.Hex()
+	return &root, nil
+}
+
+// threadRecipients returns the thread participants still taking part in the conversation, except the sender
+func threadRecipients(data *WsChatData, senderId string) []string {
+	participants := make(map[string]bool)
+	for _, id := range data.ThreadRoot.Thread.ParticipantIds {
+		participants[id] = true
+	}
+	recipients := make([]string, 0)
+	for _, id := range data.RecipientIds(senderId) {
+		if participants[id] {
+			recipients = append(recipients, id)
+		}
+	}
+	return recipients
+}
+
+// broadcastThreadUpdate sends the new reply count and participants of the thread to the whole conversation
+func (chat *Chat) broadcastThreadUpdate(data *WsChatData, senderId string) {
+	root := data.ThreadRoot
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: "thread_updated",
+		Data: &WsThreadUpdateData{
+			ChatId:    root.ChatId,
+			MessageId: root.ObjectId.Hex(),
+			Thread:    root.Thread,
+		},
+	}, append(data.RecipientIds(senderId), senderId)...)
+}
+
+// GetThread returns the thread root and a page of its replies
+func (chat *Chat) GetThread(userId string, chatId string, messageId string, q *models.ChatPageQuery) (*WsThreadData, error) {
+	chatId, err := chat.resolveChatId(userId, chatId, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	var root models.Chat
+	if err := root.FindById(chat.Mongo, chatId, messageId); err != nil {
+		return nil, ErrChatNotFound
+	}
+	page, err := models.GetChatPage(chat.Mongo, bson.M{
+		"chat_id":     chatId,
+		"thread_id":   messageId,
+		"deleted_for": bson.M{"$ne": userId},
+	}, q)
+	if err != nil {
+		return nil, err
+	}
+	return &WsThreadData{ChatId: chatId, Root: &root, ChatPage: page}, nil
+}
+
+func (chat *Chat) GetChatThread(c *gin.Context) {
+	userId := c.GetString("userId")
+	if userId == "" {
+		c.JSON(401, &schema.ErrorResponse{
+			Code:    schema.ErrAuthenticationRequired,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	var q models.ChatPageQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(400, &schema.ErrorResponse{
+			Code:    schema.ErrFieldInvalid,
+			Message: "Invalid query",
+		})
+		return
+	}
+	thread, err := chat.GetThread(userId, c.Param("chatId"), c.Param("messageId"), &q)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+	c.JSON(200, thread)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/krissukoco/go-gin-chat/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// DefaultTypingExpiry is how long a typing indicator lasts without a 'typing_stop'
+	DefaultTypingExpiry = 6 * time.Second
+	// DefaultTypingThrottle is the minimum interval between two fanned out 'typing_start' of a sender
+	DefaultTypingThrottle = 2 * time.Second
+)
+
+type WsTypingMsg struct {
+	ChatId string `json:"chat_id"`
+}
+
+type WsTypingData struct {
+	ChatId string `json:"chat_id"`
+	UserId string `json:"user_id"`
+}
+
+type typingState struct {
+	timer       *time.Timer
+	lastStarted time.Time
+	onExpire    func()
+}
+
+// TypingTracker keeps ephemeral typing state in memory, it is never persisted
+type TypingTracker struct {
+	Expiry   time.Duration
+	Throttle time.Duration
+
+	mu     sync.Mutex
+	states map[string]*typingState
+}
+
+func NewTypingTracker(expiry time.Duration, throttle time.Duration) *TypingTracker {
+	return &TypingTracker{
+		Expiry:   expiry,
+		Throttle: throttle,
+		states:   make(map[string]*typingState),
+	}
+}
+
+func typingKey(chatId string, userId string) string {
+	return chatId + "|" + userId
+}
+
+// start arms the expiry timer of the sender and tells whether 'typing_start' should be fanned out.
+// onExpire is called if no stop arrives before the expiry.
+func (t *TypingTracker) start(chatId string, userId string, onExpire func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := typingKey(chatId, userId)
+	now := time.Now()
+	state, ok := t.states[key]
+	if ok {
+		state.timer.Stop()
+		throttled := now.Sub(state.lastStarted) < t.Throttle
+		state.onExpire = onExpire
+		state.timer = t.expireAfter(key, state, onExpire)
+		if throttled {
+			return false
+		}
+		state.lastStarted = now
+		return true
+	}
+	state = &typingState{lastStarted: now, onExpire: onExpire}
+	state.timer = t.expireAfter(key, state, onExpire)
+	t.states[key] = state
+	return true
+}
+
+// refresh re-arms the expiry timer of a sender whose last fanned out 'typing_start' is within
+// the throttle interval. Returns false if there is nothing to refresh and start must be called.
+func (t *TypingTracker) refresh(chatId string, userId string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := typingKey(chatId, userId)
+	state, ok := t.states[key]
+	if !ok || time.Since(state.lastStarted) >= t.Throttle {
+		return false
+	}
+	state.timer.Stop()
+	state.timer = t.expireAfter(key, state, state.onExpire)
+	return true
+}
+
+func (t *TypingTracker) expireAfter(key string, state *typingState, onExpire func()) *time.Timer {
+	return time.AfterFunc(t.Expiry, func() {
+		t.mu.Lock()
+		current, ok := t.states[key]
+		if !ok || current != state {
+			t.mu.Unlock()
+			return
+		}
+		delete(t.states, key)
+		t.mu.Unlock()
+		onExpire()
+	})
+}
+
+// stop clears the typing state and tells whether the sender was typing
+func (t *TypingTracker) stop(chatId string, userId string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := typingKey(chatId, userId)
+	state, ok := t.states[key]
+	if !ok {
+		return false
+	}
+	state.timer.Stop()
+	delete(t.states, key)
+	return true
+}
+
+// typingChatId returns the canonical chat id of a group id, direct conversation id or user id
+// without a lookup. The throttle check relies on it, unknown ids are only rejected once resolved.
+func typingChatId(userId string, chatId string) string {
+	if models.IsDirectConversationId(chatId) || primitive.IsValidObjectID(chatId) {
+		return chatId
+	}
+	return models.DirectConversationId(userId, chatId)
+}
+
+// TypingStart fans 'typing_start' out to the other participants of the chat. Starts repeated
+// within the throttle interval only extend the indicator, without resolving the chat again.
+func (chat *Chat) TypingStart(cl *ChatClient, chatId string) error {
+	if chat.Typing.refresh(typingChatId(cl.UserId, chatId), cl.UserId) {
+		return nil
+	}
+	chatId, err := chat.resolveChatId(cl.UserId, chatId, ActionSend)
+	if err != nil {
+		return err
+	}
+	participants, err := chat.chatParticipants(chatId)
+	if err != nil {
+		return err
+	}
+	recipients := except(participants, cl.UserId)
+	userId := cl.UserId
+	fanOut := chat.Typing.start(chatId, userId, func() {
+		chat.broadcastTyping("typing_stop", chatId, userId, recipients)
+	})
+	if fanOut {
+		chat.broadcastTyping("typing_start", chatId, userId, recipients)
+	}
+	return nil
+}
+
+// TypingStop fans 'typing_stop' out to the other participants of the chat
+func (chat *Chat) TypingStop(cl *ChatClient, chatId string) error {
+	chatId, err := chat.resolveChatId(cl.UserId, chatId, ActionSend)
+	if err != nil {
+		return err
+	}
+	return chat.stopTyping(cl.UserId, chatId)
+}
+
+// stopTyping clears the typing state of the user in a canonical chat id
+func (chat *Chat) stopTyping(userId string, chatId string) error {
+	if !chat.Typing.stop(chatId, userId) {
+		return nil
+	}
+	participants, err := chat.chatParticipants(chatId)
+	if err != nil {
+		return err
+	}
+	chat.broadcastTyping("typing_stop", chatId, userId, except(participants, userId))
+	return nil
+}
+
+func (chat *Chat) broadcastTyping(eventType string, chatId string, userId string, recipients []string) {
+	chat.Hub.broadcast(&WsBaseMessage{
+		Type: eventType,
+		Data: &WsTypingData{
+			ChatId: chatId,
+			UserId: userId,
+		},
+	}, recipients...)
+}
@@ -0,0 +1,180 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+)
+
+// Decode decodes a jpeg, png, gif or webp image, returning its format name
+func Decode(r io.Reader) (image.Image, string, error) {
+	img, format, err := image.Decode(r)
+	if err == image.ErrFormat {
+		return nil, "", ErrUnsupportedFormat
+	}
+	return img, format, err
+}
+
+// Strip encodes img again without any metadata such as EXIF GPS location, since encoders
+// of the standard library write none. original is the encoded image img was decoded from.
+// Returns the new content and its MIME type: webp has no encoder and is converted to
+// lossless png, animated gifs keep every frame.
+func Strip(original []byte, img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	case "png", "webp":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	case "gif":
+		anim, err := gif.DecodeAll(bytes.NewReader(original))
+		if err != nil {
+			return nil, "", err
+		}
+		if err = gif.EncodeAll(&buf, anim); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/gif", nil
+	default:
+		return nil, "", ErrUnsupportedFormat
+	}
+}
+
+// Resize scales img so its longest side is at most maxSide, keeping the aspect ratio.
+// Images already smaller are returned unchanged.
+func Resize(img image.Image, maxSide int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+	if w >= h {
+		h = h * maxSide / w
+		w = maxSide
+	} else {
+		w = w * maxSide / h
+		h = maxSide
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// EncodeJpeg encodes a thumbnail as jpeg. Jpeg has no alpha channel so
+// transparent areas are drawn over white instead of turning black.
+func EncodeJpeg(img image.Image) ([]byte, error) {
+	if opaque, ok := img.(interface{ Opaque() bool }); !ok || !opaque.Opaque() {
+		img = flatten(img)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// flatten draws img over a white background
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// GifFrames walks the blocks of a gif without decoding them and returns its number of
+// frames and the pixels of every frame together, which is what decoding all frames costs.
+func GifFrames(data []byte) (int, int64, error) {
+	// Header and logical screen descriptor
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return 0, 0, ErrUnsupportedFormat
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	frames := 0
+	var pixels int64
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x3B:
+			// Trailer
+			return frames, pixels, nil
+		case 0x21:
+			// Extension: label then data sub-blocks
+			end, err := skipSubBlocks(data, pos+2)
+			if err != nil {
+				return 0, 0, err
+			}
+			pos = end
+		case 0x2C:
+			// Image descriptor: position, size, flags, then LZW code size and data sub-blocks
+			if pos+10 > len(data) {
+				return 0, 0, ErrUnsupportedFormat
+			}
+			w := int64(data[pos+5]) | int64(data[pos+6])<<8
+			h := int64(data[pos+7]) | int64(data[pos+8])<<8
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			end, err := skipSubBlocks(data, pos+1)
+			if err != nil {
+				return 0, 0, err
+			}
+			pos = end
+			frames++
+			pixels += w * h
+		default:
+			return 0, 0, ErrUnsupportedFormat
+		}
+	}
+	// Truncated gifs without a trailer are decoded up to the last complete frame
+	return frames, pixels, nil
+}
+
+// skipSubBlocks returns the position after the data sub-blocks starting at pos
+func skipSubBlocks(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return 0, ErrUnsupportedFormat
+		}
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos, nil
+		}
+		pos += size
+	}
+}
+
+// Blurhash returns the blurhash placeholder of img
+func Blurhash(img image.Image) (string, error) {
+	// Hashing a small version is as good and much faster
+	return blurhash.Encode(4, 3, Resize(img, 64))
+}
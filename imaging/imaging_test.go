@@ -0,0 +1,50 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+)
+
+func TestGifFrames(t *testing.T) {
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 20, 10), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	frames, pixels, err := GifFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != 3 || pixels != 600 {
+		t.Fatalf("expected 3 frames and 600 pixels, got %d and %d", frames, pixels)
+	}
+	if _, _, err = GifFrames([]byte("not a gif")); err != ErrUnsupportedFormat {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestEncodeJpegTransparentIsWhite(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 400))
+	thumb := Resize(img, 100)
+	b, err := EncodeJpeg(thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, bl, _ := decoded.At(50, 50).RGBA()
+	if r>>8 < 250 || g>>8 < 250 || bl>>8 < 250 {
+		t.Fatalf("expected a white background, got %v", color.RGBA64{uint16(r), uint16(g), uint16(bl), 0xffff})
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/krissukoco/go-gin-chat/server"
 )
 
@@ -9,5 +13,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// Stop websocket manager on interrupt
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		srv.Stop()
+		os.Exit(0)
+	}()
 	srv.Start()
 }
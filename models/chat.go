@@ -2,20 +2,48 @@ package models
 
 import (
 	"context"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
 	ChatTypeText    = "text"
 	ChatTypePoll    = "poll"
 	ChatTypeInfo    = "info"
+	ChatTypeImage   = "image"
+	ChatTypeFile    = "file"
 	ChatCollection  = "chats"
 	GroupCollection = "groups"
+
+	DefaultChatPageSize = 30
+	MaxChatPageSize     = 100
+)
+
+var (
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrChatNotEditable = errors.New("chat cannot be edited")
+	ErrReactionLimit   = errors.New("chat not found or too many distinct reactions")
 )
 
+// ChatRevision is a previous text of an edited chat
+type ChatRevision struct {
+	Text string `bson:"text" json:"text"`
+	// EditedAt is when this text was replaced
+	EditedAt int64 `bson:"edited_at" json:"edited_at"`
+}
+
+// IsEditable tells whether the chat has a text that can be edited
+func (c *Chat) IsEditable() bool {
+	if c.Deleted {
+		return false
+	}
+	return c.Type == ChatTypeText || c.Type == ChatTypeImage || c.Type == ChatTypeFile
+}
+
 type ChatRoom struct {
 	ChatId string      `json:"chat_id" bson:"chat_id"`
 	User   interface{} `json:"user" bson:"user"`
@@ -26,17 +54,42 @@ type ChatRoom struct {
 type Chat struct {
 	ObjectId primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
 	SenderId string             `bson:"sender_id" json:"sender_id"`
-	// ChatId is user id if personal chat, or group id if group chat
-	ChatId    string    `bson:"chat_id" json:"chat_id"`
-	IsGroup   bool      `bson:"is_group" json:"is_group"`
-	Type      string    `bson:"type" json:"type"`
-	Text      string    `bson:"text,omitempty" json:"text,omitempty"`
-	MediaUrls []string  `bson:"media_urls" json:"media_urls"`
-	Poll      *Poll     `bson:"poll,omitempty" json:"poll,omitempty"`
-	Info      *ChatInfo `bson:"info,omitempty" json:"info,omitempty"`
-	ReadBy    []string  `bson:"read_by" json:"read_by"`
-	CreatedAt int64     `bson:"created_at" json:"created_at"`
-	UpdatedAt int64     `bson:"updated_at" json:"updated_at"`
+	// ChatId is the direct conversation id if personal chat, or group id if group chat
+	ChatId    string   `bson:"chat_id" json:"chat_id"`
+	IsGroup   bool     `bson:"is_group" json:"is_group"`
+	Type      string   `bson:"type" json:"type"`
+	Text      string   `bson:"text,omitempty" json:"text,omitempty"`
+	MediaUrls []string `bson:"media_urls" json:"media_urls"`
+	// MediaIds are the uploaded media of an image or file chat
+	MediaIds []string  `bson:"media_ids,omitempty" json:"media_ids,omitempty"`
+	Poll     *Poll     `bson:"poll,omitempty" json:"poll,omitempty"`
+	Info     *ChatInfo `bson:"info,omitempty" json:"info,omitempty"`
+	ReadBy   []string  `bson:"read_by" json:"read_by"`
+	// DeliveredTo is a list of user ids whose device received this chat
+	DeliveredTo []string `bson:"delivered_to" json:"delivered_to"`
+	// Forwarded is set if the chat is a copy forwarded from another conversation
+	Forwarded *ChatForwardInfo `bson:"forwarded,omitempty" json:"forwarded,omitempty"`
+	// ReplyTo quotes the chat this chat replies to
+	ReplyTo *ChatReplyRef `bson:"reply_to,omitempty" json:"reply_to,omitempty"`
+	// ThreadId is the id of the thread's root chat if this chat is a thread reply
+	ThreadId string `bson:"thread_id,omitempty" json:"thread_id,omitempty"`
+	// Thread is set on the root chat of a thread
+	Thread *ThreadInfo `bson:"thread,omitempty" json:"thread,omitempty"`
+	// Reactions are the user ids who reacted, keyed by emoji
+	Reactions map[string][]string `bson:"reactions,omitempty" json:"reactions,omitempty"`
+	// PinnedAt is set while the chat is pinned in its conversation
+	PinnedAt int64  `bson:"pinned_at,omitempty" json:"pinned_at,omitempty"`
+	PinnedBy string `bson:"pinned_by,omitempty" json:"pinned_by,omitempty"`
+	// Revisions are the previous texts of an edited chat, oldest first
+	Revisions []*ChatRevision `bson:"revisions,omitempty" json:"revisions,omitempty"`
+	EditedAt  int64           `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	// Deleted marks a tombstone of a chat deleted for everyone, its content is cleared
+	Deleted   bool  `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	DeletedAt int64 `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	// DeletedFor is a list of user ids who deleted this chat for themselves only
+	DeletedFor []string `bson:"deleted_for,omitempty" json:"-"`
+	CreatedAt  int64    `bson:"created_at" json:"created_at"`
+	UpdatedAt  int64    `bson:"updated_at" json:"updated_at"`
 }
 
 func (c *Chat) Save(db *mongo.Database) error {
@@ -51,20 +104,19 @@ func (c *Chat) Save(db *mongo.Database) error {
 		}
 		return nil
 	}
-	_, err := db.Collection(ChatCollection).UpdateOne(context.Background(), bson.M{"_id": c.ObjectId}, &c)
+	_, err := db.Collection(ChatCollection).ReplaceOne(context.Background(), bson.M{"_id": c.ObjectId}, &c)
 	return err
 }
 
-func GetUserChatRooms(db *mongo.Database, userId string) ([]*ChatRoom, error) {
+// GetUserChatRooms returns every chat of the given conversations (group or direct conversation ids)
+// the user has not deleted for themselves
+func GetUserChatRooms(db *mongo.Database, userId string, chatIds []string) ([]*ChatRoom, error) {
 	ctx := context.Background()
 	rooms := map[string]*ChatRoom{}
 	chatRooms := []*ChatRoom{}
 	cursor, err := db.Collection(ChatCollection).Find(
 		ctx,
-		bson.M{"$or": []bson.M{
-			{"sender_id": userId},
-			{"chat_id": userId},
-		}},
+		bson.M{"chat_id": bson.M{"$in": chatIds}, "deleted_for": bson.M{"$ne": userId}, "thread_id": bson.M{"$exists": false}},
 	)
 	if err != nil {
 		return nil, err
@@ -100,6 +152,266 @@ func GetUserChatRooms(db *mongo.Database, userId string) ([]*ChatRoom, error) {
 	return chatRooms, nil
 }
 
+// EnsureChatIndexes creates the indexes used to paginate chat history
+func EnsureChatIndexes(db *mongo.Database) error {
+	_, err := db.Collection(ChatCollection).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "sender_id", Value: 1}, {Key: "chat_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "media_ids", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+// ChatPageQuery is a cursor over chat history.
+// Before/After are chat ids, BeforeTs/AfterTs are unix milli timestamps. Zero values are ignored.
+type ChatPageQuery struct {
+	Before   string `json:"before" form:"before"`
+	After    string `json:"after" form:"after"`
+	BeforeTs int64  `json:"before_ts" form:"before_ts"`
+	AfterTs  int64  `json:"after_ts" form:"after_ts"`
+	Size     int    `json:"size" form:"size"`
+}
+
+type ChatPage struct {
+	Chats []*Chat `json:"chats"`
+	// HasMore tells whether more chats exist past this page in the direction of the query
+	HasMore bool `json:"has_more"`
+}
+
+// cursorFilter returns the filter for chats strictly before (or after) the chat with given id,
+// ordered by created_at then _id
+func cursorFilter(db *mongo.Database, id string, before bool) (bson.M, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursorChat Chat
+	err = db.Collection(ChatCollection).FindOne(context.Background(), bson.M{"_id": objId}).Decode(&cursorChat)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	op := "$gt"
+	if before {
+		op = "$lt"
+	}
+	return bson.M{"$or": []bson.M{
+		{"created_at": bson.M{op: cursorChat.CreatedAt}},
+		{"created_at": cursorChat.CreatedAt, "_id": bson.M{op: objId}},
+	}}, nil
+}
+
+// GetChatPage returns a page of chats matching filter in chronological order.
+// Without an 'after' cursor the newest chats are returned.
+func GetChatPage(db *mongo.Database, filter bson.M, q *ChatPageQuery) (*ChatPage, error) {
+	ctx := context.Background()
+	size := q.Size
+	if size < 1 {
+		size = DefaultChatPageSize
+	}
+	if size > MaxChatPageSize {
+		size = MaxChatPageSize
+	}
+
+	conditions := []bson.M{filter}
+	if q.Before != "" {
+		f, err := cursorFilter(db, q.Before, true)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, f)
+	}
+	if q.After != "" {
+		f, err := cursorFilter(db, q.After, false)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, f)
+	}
+	if q.BeforeTs > 0 {
+		conditions = append(conditions, bson.M{"created_at": bson.M{"$lt": q.BeforeTs}})
+	}
+	if q.AfterTs > 0 {
+		conditions = append(conditions, bson.M{"created_at": bson.M{"$gt": q.AfterTs}})
+	}
+
+	// Walk forward from an 'after' cursor, otherwise backward from the newest
+	forward := q.After != "" || q.AfterTs > 0
+	order := -1
+	if forward {
+		order = 1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(size + 1))
+	cursor, err := db.Collection(ChatCollection).Find(ctx, bson.M{"$and": conditions}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	chats := make([]*Chat, 0)
+	if err = cursor.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+
+	page := &ChatPage{Chats: chats}
+	if len(chats) > size {
+		page.HasMore = true
+		page.Chats = chats[:size]
+	}
+	if !forward {
+		// Return in chronological order
+		for i, j := 0, len(page.Chats)-1; i < j; i, j = i+1, j-1 {
+			page.Chats[i], page.Chats[j] = page.Chats[j], page.Chats[i]
+		}
+	}
+	return page, nil
+}
+
+const (
+	ReceiptRead      = "read"
+	ReceiptDelivered = "delivered"
+)
+
+// FindById finds the chat with given id in the conversation chatId
+func (c *Chat) FindById(db *mongo.Database, chatId string, id string) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	return db.Collection(ChatCollection).FindOne(context.Background(), bson.M{"_id": objId, "chat_id": chatId}).Decode(&c)
+}
+
+// MarkChats records a read or delivered receipt of userId on every chat of chatId
+// sent by someone else, up to and including the chat upToId (every chat if empty).
+// Reading a chat also marks it delivered. Returns the chats newly marked.
+func MarkChats(db *mongo.Database, chatId string, userId string, upToId string, receipt string) ([]*Chat, error) {
+	ctx := context.Background()
+	field := "read_by"
+	if receipt == ReceiptDelivered {
+		field = "delivered_to"
+	}
+	conditions := []bson.M{{
+		"chat_id":   chatId,
+		"sender_id": bson.M{"$ne": userId},
+		field:       bson.M{"$ne": userId},
+	}}
+	if upToId != "" {
+		f, err := cursorFilter(db, upToId, true)
+		if err != nil {
+			return nil, err
+		}
+		objId, _ := primitive.ObjectIDFromHex(upToId)
+		conditions = append(conditions, bson.M{"$or": bson.A{f, bson.M{"_id": objId}}})
+	}
+	filter := bson.M{"$and": conditions}
+	cursor, err := db.Collection(ChatCollection).Find(
+		ctx,
+		filter,
+		options.Find().SetProjection(bson.M{"_id": 1, "sender_id": 1, "chat_id": 1, "created_at": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	chats := make([]*Chat, 0)
+	if err = cursor.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+	if len(chats) == 0 {
+		return chats, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(chats))
+	for _, c := range chats {
+		ids = append(ids, c.ObjectId)
+	}
+	update := bson.M{field: userId}
+	if receipt == ReceiptRead {
+		update["delivered_to"] = userId
+	}
+	_, err = db.Collection(ChatCollection).UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"$addToSet": update},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+// ConversationSummary is an entry of a user's conversation list
+type ConversationSummary struct {
+	// ChatId is the group id or the direct conversation id
+	ChatId      string `bson:"_id" json:"chat_id"`
+	IsGroup     bool   `bson:"is_group" json:"is_group"`
+	LastMessage *Chat  `bson:"last_message" json:"last_message"`
+	UnreadCount int    `bson:"unread_count" json:"unread_count"`
+	User        *User  `bson:"-" json:"user,omitempty"`
+	Group       *Group `bson:"-" json:"group,omitempty"`
+}
+
+// GetConversationSummaries returns the conversations of the user sorted by most recent activity.
+// chatIds are the groups and direct conversations the user takes part in.
+func GetConversationSummaries(db *mongo.Database, userId string, chatIds []string, offset int, limit int) ([]*ConversationSummary, error) {
+	ctx := context.Background()
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"chat_id": bson.M{"$in": chatIds}, "deleted_for": bson.M{"$ne": userId}, "thread_id": bson.M{"$exists": false}}}},
+		// Same keys as the chat_id, created_at, _id index so the sort walks the index instead of sorting in memory
+		{{Key: "$sort", Value: bson.D{{Key: "chat_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          "$chat_id",
+			"is_group":     bson.M{"$first": "$is_group"},
+			"last_message": bson.M{"$first": "$$ROOT"},
+			"unread_count": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$and": bson.A{
+					bson.M{"$ne": bson.A{"$sender_id", userId}},
+					bson.M{"$not": bson.A{bson.M{"$in": bson.A{userId, bson.M{"$ifNull": bson.A{"$read_by", bson.A{}}}}}}},
+				}},
+				1,
+				0,
+			}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "last_message.created_at", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: offset}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := db.Collection(ChatCollection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	summaries := make([]*ConversationSummary, 0)
+	if err = cursor.All(ctx, &summaries); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// ChatForwardInfo records where a forwarded chat comes from
+type ChatForwardInfo struct {
+	// OriginalSenderId is the sender of the first chat of the forward chain
+	OriginalSenderId  string `bson:"original_sender_id" json:"original_sender_id"`
+	OriginalMessageId string `bson:"original_message_id" json:"original_message_id"`
+	// ForwardCount is how many times the content was forwarded along the chain
+	ForwardCount int `bson:"forward_count" json:"forward_count"`
+}
+
+// ForwardInfo returns the forward info of a copy of the chat
+func (c *Chat) ForwardInfo() *ChatForwardInfo {
+	if c.Forwarded != nil {
+		return &ChatForwardInfo{
+			OriginalSenderId:  c.Forwarded.OriginalSenderId,
+			OriginalMessageId: c.Forwarded.OriginalMessageId,
+			ForwardCount:      c.Forwarded.ForwardCount + 1,
+		}
+	}
+	return &ChatForwardInfo{
+		OriginalSenderId:  c.SenderId,
+		OriginalMessageId: c.ObjectId.Hex(),
+		ForwardCount:      1,
+	}
+}
+
 type PollOption struct {
 	Text string `bson:"text" json:"text"`
 	// UserVotes is a list of user ids who voted this option
@@ -109,14 +421,357 @@ type PollOption struct {
 type Poll struct {
 	Question string        `bson:"question" json:"question"`
 	Options  []*PollOption `bson:"options" json:"options"`
+	// MultipleChoice allows a user to vote for more than one option
+	MultipleChoice bool  `bson:"multiple_choice" json:"multiple_choice"`
+	Closed         bool  `bson:"closed" json:"closed"`
+	ClosedAt       int64 `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
 }
 
+// Snapshot returns an open copy of the poll with the same question and options and no votes
+func (p *Poll) Snapshot() *Poll {
+	options := make([]*PollOption, 0, len(p.Options))
+	for _, opt := range p.Options {
+		options = append(options, &PollOption{Text: opt.Text, UserVotes: make([]string, 0)})
+	}
+	return &Poll{
+		Question:       p.Question,
+		Options:        options,
+		MultipleChoice: p.MultipleChoice,
+	}
+}
+
+var (
+	ErrPollNotFound = errors.New("poll not found or closed")
+)
+
+// FindByMediaId finds a chat referencing the media in one of the given conversations
+func (c *Chat) FindByMediaId(db *mongo.Database, mediaId string, chatIds []string) error {
+	return db.Collection(ChatCollection).FindOne(
+		context.Background(),
+		bson.M{"media_ids": mediaId, "chat_id": bson.M{"$in": chatIds}},
+	).Decode(&c)
+}
+
+// GetMediaChatIds returns the conversations with a chat referencing the media
+func GetMediaChatIds(db *mongo.Database, mediaId string) ([]string, error) {
+	values, err := db.Collection(ChatCollection).Distinct(context.Background(), "chat_id", bson.M{"media_ids": mediaId})
+	if err != nil {
+		return nil, err
+	}
+	chatIds := make([]string, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			chatIds = append(chatIds, id)
+		}
+	}
+	return chatIds, nil
+}
+
+// EditChat atomically replaces the text of an editable chat of the sender created at or after notBefore,
+// keeping the previous text as a revision, and refreshes the quotes of its replies. Returns the updated chat.
+func EditChat(db *mongo.Database, id string, senderId string, text string, notBefore int64, now int64) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrChatNotEditable
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{
+			"_id":        objId,
+			"sender_id":  senderId,
+			"type":       bson.M{"$in": bson.A{ChatTypeText, ChatTypeImage, ChatTypeFile}},
+			"deleted":    bson.M{"$ne": true},
+			"created_at": bson.M{"$gte": notBefore},
+		},
+		editChatUpdate(text, now),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrChatNotEditable
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Replies quoting the chat show the new text
+	if err = updateReplyRefs(db, c.ChatId, id, c.Snippet(), false); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// editChatUpdate is the pipeline update of EditChat. The text is wrapped in $literal since a
+// pipeline reads strings starting with '$' as field paths or variables.
+func editChatUpdate(text string, now int64) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"revisions": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+				bson.A{bson.M{"text": bson.M{"$ifNull": bson.A{"$text", ""}}, "edited_at": now}},
+			}},
+			"text":       bson.M{"$literal": text},
+			"edited_at":  now,
+			"updated_at": now,
+		}}},
+	}
+}
+
+// DeleteChatForEveryone turns a chat of the sender into a tombstone, clearing its content, revisions, pin
+// and the quotes of its replies.
+// Returns the tombstone.
+func DeleteChatForEveryone(db *mongo.Database, id string, senderId string, now int64) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrChatNotEditable
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId, "sender_id": senderId, "type": bson.M{"$ne": ChatTypeInfo}, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$set": bson.M{
+				"deleted":    true,
+				"deleted_at": now,
+				"updated_at": now,
+				"media_urls": bson.A{},
+			},
+			"$unset": bson.M{
+				"text": "", "media_ids": "", "poll": "", "revisions": "", "edited_at": "", "reactions": "",
+				"pinned_at": "", "pinned_by": "",
+			},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrChatNotEditable
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A deleted chat gives its pin slot back
+	if err = releasePinSlot(db, c.ChatId, id); err != nil {
+		return nil, err
+	}
+	// Replies stop quoting the deleted content
+	if err = updateReplyRefs(db, c.ChatId, id, "", true); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// DeleteChatForUser hides a chat from the user's history only
+func DeleteChatForUser(db *mongo.Database, id string, userId string) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrChatNotEditable
+	}
+	_, err = db.Collection(ChatCollection).UpdateOne(
+		context.Background(),
+		bson.M{"_id": objId},
+		bson.M{"$addToSet": bson.M{"deleted_for": userId}},
+	)
+	return err
+}
+
+// ReactChat atomically adds the user's reaction with emoji to a chat which is not deleted.
+// A new emoji is only accepted while the chat has less than maxDistinct emojis, zero for no limit.
+// Emoji must not contain '.' nor '$'. Returns the updated chat.
+func ReactChat(db *mongo.Database, id string, userId string, emoji string, maxDistinct int) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrReactionLimit
+	}
+	field := "reactions." + emoji
+	filter := bson.M{"_id": objId, "deleted": bson.M{"$ne": true}}
+	if maxDistinct > 0 {
+		filter["$or"] = bson.A{
+			bson.M{field: bson.M{"$exists": true}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$reactions", bson.M{}}}}},
+				maxDistinct,
+			}}},
+		}
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		filter,
+		bson.M{"$addToSet": bson.M{field: userId}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrReactionLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// UnreactChat atomically removes the user's reaction with emoji from a chat,
+// dropping the emoji once nobody reacts with it. Returns the updated chat.
+func UnreactChat(db *mongo.Database, id string, userId string, emoji string) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrReactionLimit
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"reactions": bson.M{"$arrayToObject": bson.M{"$filter": bson.M{
+				"input": bson.M{"$map": bson.M{
+					"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$reactions", bson.M{}}}},
+					"as":    "r",
+					"in": bson.M{
+						"k": "$$r.k",
+						"v": bson.M{"$cond": bson.A{
+							bson.M{"$eq": bson.A{"$$r.k", bson.M{"$literal": emoji}}},
+							bson.M{"$setDifference": bson.A{"$$r.v", bson.A{bson.M{"$literal": userId}}}},
+							"$$r.v",
+						}},
+					},
+				}},
+				"as":   "r",
+				"cond": bson.M{"$gt": bson.A{bson.M{"$size": "$$r.v"}, 0}},
+			}}},
+		}}},
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrReactionLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// FindByMessageId finds the chat with given id in any conversation
+func (c *Chat) FindByMessageId(db *mongo.Database, id string) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	return db.Collection(ChatCollection).FindOne(context.Background(), bson.M{"_id": objId}).Decode(&c)
+}
+
+// VotePoll atomically replaces the votes of userId on an open poll with the given option indexes,
+// an empty list retracts every vote of the user. Returns the updated chat.
+func VotePoll(db *mongo.Database, messageId string, userId string, optionIndexes []int) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrPollNotFound
+	}
+	if optionIndexes == nil {
+		optionIndexes = []int{}
+	}
+	withoutUser := bson.M{"$setDifference": bson.A{bson.M{"$ifNull": bson.A{"$$opt.user_votes", bson.A{}}}, bson.A{userId}}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"poll.options": bson.M{"$map": bson.M{
+				"input": bson.M{"$range": bson.A{0, bson.M{"$size": "$poll.options"}}},
+				"as":    "i",
+				"in": bson.M{"$let": bson.M{
+					"vars": bson.M{"opt": bson.M{"$arrayElemAt": bson.A{"$poll.options", "$$i"}}},
+					"in": bson.M{
+						"text": "$$opt.text",
+						"user_votes": bson.M{"$cond": bson.A{
+							bson.M{"$in": bson.A{"$$i", optionIndexes}},
+							bson.M{"$concatArrays": bson.A{withoutUser, bson.A{userId}}},
+							withoutUser,
+						}},
+					},
+				}},
+			}},
+		}}},
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId, "type": ChatTypePoll, "poll.closed": bson.M{"$ne": true}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ClosePoll closes an open poll created by userId. Returns the updated chat.
+func ClosePoll(db *mongo.Database, messageId string, userId string, now int64) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(messageId)
+	if err != nil {
+		return nil, ErrPollNotFound
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId, "type": ChatTypePoll, "sender_id": userId, "poll.closed": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"poll.closed": true, "poll.closed_at": now, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ChatInfo types
+const (
+	ChatInfoGroupCreated     = "group_created"
+	ChatInfoMemberAdded      = "member_added"
+	ChatInfoMemberRemoved    = "member_removed"
+	ChatInfoMemberLeft       = "member_left"
+	ChatInfoMemberJoined     = "member_joined"
+	ChatInfoAdminPromoted    = "admin_promoted"
+	ChatInfoAdminDemoted     = "admin_demoted"
+	ChatInfoOwnerTransferred = "owner_transferred"
+	ChatInfoNameChanged      = "name_changed"
+	ChatInfoDescChanged      = "description_changed"
+	ChatInfoAvatarChanged    = "avatar_changed"
+	ChatInfoSettingsChanged  = "settings_changed"
+	ChatInfoChatPinned       = "chat_pinned"
+	ChatInfoChatUnpinned     = "chat_unpinned"
+)
+
 // ChatInfo is for 'notifications' on group
 // e.g. user joined, user left, group created, image changed, etc
 type ChatInfo struct {
 	Type string `bson:"type" json:"type"`
 	// UserId is the user who did the action
-	UserId    string `bson:"user_id" json:"user_id"`
+	UserId string `bson:"user_id" json:"user_id"`
+	// TargetIds are the users the action was done to, if any
+	TargetIds []string `bson:"target_ids,omitempty" json:"target_ids,omitempty"`
+	// MessageId is the chat the action was done to, if any
+	MessageId string `bson:"message_id,omitempty" json:"message_id,omitempty"`
 	Message   string `bson:"message" json:"message"`
 	Timestamp int64  `bson:"timestamp" json:"timestamp"`
 }
+
+// NewInfoChat returns an info chat of the conversation timeline, sent by the user who did the action
+func NewInfoChat(chatId string, info *ChatInfo) *Chat {
+	return &Chat{
+		SenderId:    info.UserId,
+		ChatId:      chatId,
+		IsGroup:     !IsDirectConversationId(chatId),
+		Type:        ChatTypeInfo,
+		Info:        info,
+		MediaUrls:   make([]string, 0),
+		ReadBy:      make([]string, 0),
+		DeliveredTo: make([]string, 0),
+		CreatedAt:   info.Timestamp,
+		UpdatedAt:   info.Timestamp,
+	}
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to the Mongo of MONGO_URI and returns a throwaway database,
+// the test is skipped if MONGO_URI is unset
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("go_gin_chat_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestEditChatUpdateTextIsLiteral(t *testing.T) {
+	update := editChatUpdate("$sender_id", 1)
+	set, ok := update[0][0].Value.(bson.M)
+	if !ok {
+		t.Fatalf("unexpected update %v", update)
+	}
+	text, ok := set["text"].(bson.M)
+	if !ok || text["$literal"] != "$sender_id" {
+		t.Fatalf("text is not a literal: %v", set["text"])
+	}
+}
+
+func TestEditChatDollarText(t *testing.T) {
+	db := testDatabase(t)
+	for _, text := range []string{"$5 for lunch", "$sender_id", "$$ROOT"} {
+		c := &Chat{
+			SenderId:  "u_sender",
+			ChatId:    DirectConversationId("u_sender", "u_receiver"),
+			Type:      ChatTypeText,
+			Text:      "original",
+			CreatedAt: 100,
+			UpdatedAt: 100,
+		}
+		if err := c.Save(db); err != nil {
+			t.Fatal(err)
+		}
+		edited, err := EditChat(db, c.ObjectId.Hex(), c.SenderId, text, 0, 200)
+		if err != nil {
+			t.Fatalf("editing to %q: %v", text, err)
+		}
+		if edited.Text != text {
+			t.Fatalf("expected text %q, got %q", text, edited.Text)
+		}
+		var stored Chat
+		if err = db.Collection(ChatCollection).FindOne(context.Background(), bson.M{"_id": c.ObjectId}).Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Text != text || len(stored.Revisions) != 1 || stored.Revisions[0].Text != "original" {
+			t.Fatalf("unexpected stored chat for %q: text %q, revisions %+v", text, stored.Text, stored.Revisions)
+		}
+	}
+}
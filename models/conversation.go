@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ConversationCollection = "conversations"
+	ConversationTypeDirect = "direct"
+	// DirectConversationPrefix prefixes every direct conversation id
+	DirectConversationPrefix = "dm:"
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+)
+
+// Conversation is a direct message thread between two users.
+// Group threads are keyed by the group id instead.
+type Conversation struct {
+	Id             string   `bson:"_id" json:"id"`
+	Type           string   `bson:"type" json:"type"`
+	ParticipantIds []string `bson:"participant_ids" json:"participant_ids"`
+	CreatedAt      int64    `bson:"created_at" json:"created_at"`
+	UpdatedAt      int64    `bson:"updated_at" json:"updated_at"`
+}
+
+// DirectConversationId returns the canonical conversation id of two users,
+// it is the same whichever user is given first
+func DirectConversationId(userA string, userB string) string {
+	ids := []string{userA, userB}
+	sort.Strings(ids)
+	return DirectConversationPrefix + ids[0] + ":" + ids[1]
+}
+
+func IsDirectConversationId(id string) bool {
+	return strings.HasPrefix(id, DirectConversationPrefix)
+}
+
+// HasParticipant tells whether the user takes part in the conversation
+func (c *Conversation) HasParticipant(userId string) bool {
+	for _, id := range c.ParticipantIds {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerId returns the other participant of a direct conversation
+func (c *Conversation) PeerId(userId string) string {
+	for _, id := range c.ParticipantIds {
+		if id != userId {
+			return id
+		}
+	}
+	return userId
+}
+
+func (c *Conversation) FindById(db *mongo.Database, id string) error {
+	err := db.Collection(ConversationCollection).FindOne(context.Background(), bson.M{"_id": id}).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return ErrConversationNotFound
+	}
+	return err
+}
+
+// FindOrCreateDirectConversation returns the direct conversation of two users, creating it if needed
+func FindOrCreateDirectConversation(db *mongo.Database, userA string, userB string, now int64) (*Conversation, error) {
+	id := DirectConversationId(userA, userB)
+	participants := []string{userA, userB}
+	sort.Strings(participants)
+	var conv Conversation
+	err := db.Collection(ConversationCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": id},
+		bson.M{"$setOnInsert": bson.M{
+			"type":            ConversationTypeDirect,
+			"participant_ids": participants,
+			"created_at":      now,
+			"updated_at":      now,
+		}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&conv)
+	if err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// GetUserConversations returns every direct conversation the user takes part in
+func GetUserConversations(db *mongo.Database, userId string) ([]*Conversation, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(ConversationCollection).Find(ctx, bson.M{"participant_ids": userId})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	convs := make([]*Conversation, 0)
+	if err = cursor.All(ctx, &convs); err != nil {
+		return nil, err
+	}
+	return convs, nil
+}
+
+// SharesConversation tells whether both users take part in a direct conversation or a group
+func SharesConversation(db *mongo.Database, userA string, userB string) (bool, error) {
+	ctx := context.Background()
+	n, err := db.Collection(ConversationCollection).CountDocuments(
+		ctx,
+		bson.M{"_id": DirectConversationId(userA, userB)},
+		options.Count().SetLimit(1),
+	)
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+	n, err = db.Collection(GroupCollection).CountDocuments(
+		ctx,
+		bson.M{"member_ids": bson.M{"$all": bson.A{userA, userB}}},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func EnsureConversationIndexes(db *mongo.Database) error {
+	_, err := db.Collection(ConversationCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "participant_ids", Value: 1}},
+	})
+	return err
+}
+
+// MigrateDirectConversations rewrites direct chats keyed by the receiver's user id
+// to the canonical conversation id, creating the conversations on the way.
+// It is safe to run more than once. Returns the number of chats rewritten.
+func MigrateDirectConversations(db *mongo.Database) (int64, error) {
+	ctx := context.Background()
+	legacy := bson.M{
+		"is_group": false,
+		"chat_id":  bson.M{"$not": bson.M{"$regex": "^" + DirectConversationPrefix}},
+	}
+	cursor, err := db.Collection(ChatCollection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: legacy}},
+		{{Key: "$group", Value: bson.M{
+			"_id":        bson.M{"sender_id": "$sender_id", "chat_id": "$chat_id"},
+			"created_at": bson.M{"$min": "$created_at"},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var total int64
+	for cursor.Next(ctx) {
+		var pair struct {
+			Id struct {
+				SenderId string `bson:"sender_id"`
+				ChatId   string `bson:"chat_id"`
+			} `bson:"_id"`
+			CreatedAt int64 `bson:"created_at"`
+		}
+		if err := cursor.Decode(&pair); err != nil {
+			return total, err
+		}
+		conv, err := FindOrCreateDirectConversation(db, pair.Id.SenderId, pair.Id.ChatId, pair.CreatedAt)
+		if err != nil {
+			return total, err
+		}
+		r, err := db.Collection(ChatCollection).UpdateMany(
+			ctx,
+			bson.M{"is_group": false, "sender_id": pair.Id.SenderId, "chat_id": pair.Id.ChatId},
+			bson.M{"$set": bson.M{"chat_id": conv.Id}},
+		)
+		if err != nil {
+			return total, err
+		}
+		total += r.ModifiedCount
+	}
+	return total, cursor.Err()
+}
+
+// DirectConversationParticipants returns the two user ids encoded in a direct conversation id
+func DirectConversationParticipants(id string) []string {
+	parts := strings.Split(strings.TrimPrefix(id, DirectConversationPrefix), ":")
+	if len(parts) != 2 {
+		return nil
+	}
+	return parts
+}
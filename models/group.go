@@ -2,24 +2,47 @@ package models
 
 import (
 	"context"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Group struct {
 	ObjectId primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
 	Name     string             `bson:"name" json:"name"`
+	// Description is an optional text about the group
+	Description string `bson:"description" json:"description"`
+	// AvatarMediaId is the uploaded image of the group
+	AvatarMediaId string `bson:"avatar_media_id,omitempty" json:"avatar_media_id,omitempty"`
+	// AvatarUrl is a signed download url of the avatar, never stored
+	AvatarUrl string        `bson:"-" json:"avatar_url,omitempty"`
+	Settings  GroupSettings `bson:"settings" json:"settings"`
 	// MemberIds is a list of user ids who are members of this group
 	MemberIds []string `bson:"member_ids" json:"member_ids"`
 	// AdminIds is a list of user ids who are admins of this group
-	AdminIds  []string `bson:"admin_ids" json:"admin_ids"`
-	CreatedAt int64    `bson:"created_at" json:"created_at"`
-	CreatedBy string   `bson:"created_by" json:"created_by"`
-	UpdatedAt int64    `bson:"updated_at" json:"updated_at"`
+	AdminIds []string `bson:"admin_ids" json:"admin_ids"`
+	// OwnerId is the user who owns the group, the creator unless ownership was transferred
+	OwnerId   string `bson:"owner_id" json:"owner_id"`
+	CreatedAt int64  `bson:"created_at" json:"created_at"`
+	CreatedBy string `bson:"created_by" json:"created_by"`
+	UpdatedAt int64  `bson:"updated_at" json:"updated_at"`
 }
 
+// GroupSettings restrict what members who are not admin can do
+type GroupSettings struct {
+	// OnlyAdminsSend is the announcement mode, only admins can send chats
+	OnlyAdminsSend bool `bson:"only_admins_send" json:"only_admins_send"`
+	// OnlyAdminsEditInfo restricts editing the name, description and avatar to admins
+	OnlyAdminsEditInfo bool `bson:"only_admins_edit_info" json:"only_admins_edit_info"`
+}
+
+var (
+	ErrGroupNotFound = errors.New("group not found")
+)
+
 func (g *Group) FindById(db *mongo.Database, id string) error {
 	objId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -30,9 +53,196 @@ func (g *Group) FindById(db *mongo.Database, id string) error {
 
 func (g *Group) Save(db *mongo.Database) error {
 	if g.ObjectId.IsZero() {
-		_, err := db.Collection(GroupCollection).InsertOne(context.Background(), &g)
-		return err
+		r, err := db.Collection(GroupCollection).InsertOne(context.Background(), &g)
+		if err != nil {
+			return err
+		}
+		oid, ok := r.InsertedID.(primitive.ObjectID)
+		if ok {
+			g.ObjectId = oid
+		}
+		return nil
 	}
-	_, err := db.Collection(GroupCollection).UpdateOne(context.Background(), bson.M{"_id": g.ObjectId}, &g)
+	_, err := db.Collection(GroupCollection).ReplaceOne(context.Background(), bson.M{"_id": g.ObjectId}, &g)
 	return err
 }
+
+func (g *Group) IsMember(userId string) bool {
+	return contains(g.MemberIds, userId)
+}
+
+func (g *Group) IsAdmin(userId string) bool {
+	return contains(g.AdminIds, userId)
+}
+
+// Owner returns the owner's user id, groups created before ownership existed are owned by their creator
+func (g *Group) Owner() string {
+	if g.OwnerId == "" {
+		return g.CreatedBy
+	}
+	return g.OwnerId
+}
+
+func (g *Group) IsOwner(userId string) bool {
+	return g.Owner() == userId
+}
+
+// update atomically applies the update to the group and reloads it
+func (g *Group) update(db *mongo.Database, update bson.M, now int64) error {
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["updated_at"] = now
+	err := db.Collection(GroupCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": g.ObjectId},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&g)
+	if err == mongo.ErrNoDocuments {
+		return ErrGroupNotFound
+	}
+	return err
+}
+
+// SetFields atomically sets the given fields of the group
+func (g *Group) SetFields(db *mongo.Database, fields bson.M, now int64) error {
+	return g.update(db, bson.M{"$set": fields}, now)
+}
+
+// AddMembers adds the users to the group, users already member are ignored
+func (g *Group) AddMembers(db *mongo.Database, userIds []string, now int64) error {
+	return g.update(db, bson.M{"$addToSet": bson.M{"member_ids": bson.M{"$each": userIds}}}, now)
+}
+
+// RemoveMember removes the user from the members and the admins of the group
+func (g *Group) RemoveMember(db *mongo.Database, userId string, now int64) error {
+	return g.update(db, bson.M{"$pull": bson.M{"member_ids": userId, "admin_ids": userId}}, now)
+}
+
+func (g *Group) AddAdmin(db *mongo.Database, userId string, now int64) error {
+	return g.update(db, bson.M{"$addToSet": bson.M{"admin_ids": userId}}, now)
+}
+
+func (g *Group) RemoveAdmin(db *mongo.Database, userId string, now int64) error {
+	return g.update(db, bson.M{"$pull": bson.M{"admin_ids": userId}}, now)
+}
+
+// TransferOwnership makes the user owner of the group, the new owner is made admin as well
+func (g *Group) TransferOwnership(db *mongo.Database, userId string, now int64) error {
+	return g.update(db, bson.M{
+		"$set":      bson.M{"owner_id": userId},
+		"$addToSet": bson.M{"admin_ids": userId},
+	}, now)
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUserGroups returns every group the user is member of
+func GetUserGroups(db *mongo.Database, userId string) ([]*Group, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(GroupCollection).Find(ctx, bson.M{"member_ids": userId})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	groups := make([]*Group, 0)
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// GetUserGroupsPage returns a page of the groups the user is member of, most recently updated first
+func GetUserGroupsPage(db *mongo.Database, userId string, offset int, limit int) ([]*Group, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(GroupCollection).Find(
+		ctx,
+		bson.M{"member_ids": userId},
+		options.Find().
+			SetSort(bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	groups := make([]*Group, 0)
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// GetUserGroupIds returns the ids of every group the user is member of
+func GetUserGroupIds(db *mongo.Database, userId string) ([]string, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(GroupCollection).Find(
+		ctx,
+		bson.M{"member_ids": userId},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	ids := make([]string, 0)
+	for cursor.Next(ctx) {
+		var g Group
+		if err := cursor.Decode(&g); err != nil {
+			return nil, err
+		}
+		ids = append(ids, g.ObjectId.Hex())
+	}
+	return ids, nil
+}
+
+// GetGroupsByIds returns the groups with given ids, keyed by id
+func GetGroupsByIds(db *mongo.Database, ids []string) (map[string]*Group, error) {
+	ctx := context.Background()
+	objIds := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			continue
+		}
+		objIds = append(objIds, objId)
+	}
+	groups := make(map[string]*Group)
+	if len(objIds) == 0 {
+		return groups, nil
+	}
+	cursor, err := db.Collection(GroupCollection).Find(ctx, bson.M{"_id": bson.M{"$in": objIds}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var g Group
+		if err := cursor.Decode(&g); err != nil {
+			return nil, err
+		}
+		groups[g.ObjectId.Hex()] = &g
+	}
+	return groups, nil
+}
+
+// IsMemberGroupAvatar tells whether the media is the avatar of a group the user is member of
+func IsMemberGroupAvatar(db *mongo.Database, mediaId string, userId string) (bool, error) {
+	n, err := db.Collection(GroupCollection).CountDocuments(
+		context.Background(),
+		bson.M{"avatar_media_id": mediaId, "member_ids": userId},
+		options.Count().SetLimit(1),
+	)
+	return n > 0, err
+}
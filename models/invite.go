@@ -0,0 +1,243 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	GroupInviteCollection      = "group_invites"
+	GroupJoinRequestCollection = "group_join_requests"
+
+	JoinRequestPending  = "pending"
+	JoinRequestApproved = "approved"
+	JoinRequestRejected = "rejected"
+)
+
+var (
+	// ErrInviteInvalid is returned for unknown, revoked, expired or used up invites
+	ErrInviteInvalid       = errors.New("invite is invalid or expired")
+	ErrJoinRequestNotFound = errors.New("join request not found")
+	ErrJoinRequestPending  = errors.New("a join request is already pending")
+)
+
+// GroupInvite is a code anyone can use to join a group
+type GroupInvite struct {
+	ObjectId  primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Code      string             `bson:"code" json:"code"`
+	GroupId   string             `bson:"group_id" json:"group_id"`
+	CreatedBy string             `bson:"created_by" json:"created_by"`
+	CreatedAt int64              `bson:"created_at" json:"created_at"`
+	// ExpiresAt is zero if the invite never expires
+	ExpiresAt int64 `bson:"expires_at" json:"expires_at"`
+	// MaxUses is zero if the invite can be used any number of times
+	MaxUses int `bson:"max_uses" json:"max_uses"`
+	Uses    int `bson:"uses" json:"uses"`
+	// RequiresApproval queues a join request for admins instead of joining directly
+	RequiresApproval bool `bson:"requires_approval" json:"requires_approval"`
+	Revoked          bool `bson:"revoked" json:"revoked"`
+}
+
+// GroupJoinRequest is a user waiting for admins to let them in
+type GroupJoinRequest struct {
+	ObjectId   primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	GroupId    string             `bson:"group_id" json:"group_id"`
+	UserId     string             `bson:"user_id" json:"user_id"`
+	InviteCode string             `bson:"invite_code" json:"invite_code"`
+	Status     string             `bson:"status" json:"status"`
+	CreatedAt  int64              `bson:"created_at" json:"created_at"`
+	// DecidedBy is the admin who approved or rejected the request
+	DecidedBy string `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+	DecidedAt int64  `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+}
+
+// NewInviteCode returns a random url safe code
+func NewInviteCode() (string, error) {
+	b := make([]byte, 9)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (i *GroupInvite) Save(db *mongo.Database) error {
+	if i.ObjectId.IsZero() {
+		r, err := db.Collection(GroupInviteCollection).InsertOne(context.Background(), &i)
+		if err != nil {
+			return err
+		}
+		oid, ok := r.InsertedID.(primitive.ObjectID)
+		if ok {
+			i.ObjectId = oid
+		}
+		return nil
+	}
+	_, err := db.Collection(GroupInviteCollection).ReplaceOne(context.Background(), bson.M{"_id": i.ObjectId}, &i)
+	return err
+}
+
+// FindByCode loads a valid invite without counting a use
+func (i *GroupInvite) FindByCode(db *mongo.Database, code string, now int64) error {
+	err := db.Collection(GroupInviteCollection).FindOne(
+		context.Background(),
+		bson.M{
+			"code":    code,
+			"revoked": false,
+			"$or":     bson.A{bson.M{"expires_at": 0}, bson.M{"expires_at": bson.M{"$gt": now}}},
+		},
+	).Decode(&i)
+	if err == mongo.ErrNoDocuments {
+		return ErrInviteInvalid
+	}
+	return err
+}
+
+// Use atomically counts one use of a valid invite and loads it
+func (i *GroupInvite) Use(db *mongo.Database, code string, now int64) error {
+	err := db.Collection(GroupInviteCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{
+			"code":    code,
+			"revoked": false,
+			"$and": bson.A{
+				bson.M{"$or": bson.A{bson.M{"expires_at": 0}, bson.M{"expires_at": bson.M{"$gt": now}}}},
+				bson.M{"$or": bson.A{bson.M{"max_uses": 0}, bson.M{"$expr": bson.M{"$lt": bson.A{"$uses", "$max_uses"}}}}},
+			},
+		},
+		bson.M{"$inc": bson.M{"uses": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&i)
+	if err == mongo.ErrNoDocuments {
+		return ErrInviteInvalid
+	}
+	return err
+}
+
+// GetGroupInvites returns the invites of the group which are not revoked, newest first
+func GetGroupInvites(db *mongo.Database, groupId string) ([]*GroupInvite, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(GroupInviteCollection).Find(
+		ctx,
+		bson.M{"group_id": groupId, "revoked": false},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	invites := make([]*GroupInvite, 0)
+	if err = cursor.All(ctx, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// RevokeGroupInvite revokes an invite of the group
+func RevokeGroupInvite(db *mongo.Database, groupId string, code string) error {
+	r, err := db.Collection(GroupInviteCollection).UpdateOne(
+		context.Background(),
+		bson.M{"group_id": groupId, "code": code, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+	if r.MatchedCount == 0 {
+		return ErrInviteInvalid
+	}
+	return nil
+}
+
+// CreateJoinRequest queues a pending join request, a pending request of the same user is returned as is
+func CreateJoinRequest(db *mongo.Database, groupId string, userId string, code string, now int64) (*GroupJoinRequest, error) {
+	var req GroupJoinRequest
+	err := db.Collection(GroupJoinRequestCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"group_id": groupId, "user_id": userId, "status": JoinRequestPending},
+		bson.M{"$setOnInsert": bson.M{
+			"invite_code": code,
+			"created_at":  now,
+		}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// HasPendingJoinRequest tells whether the user is waiting for a decision on joining the group
+func HasPendingJoinRequest(db *mongo.Database, groupId string, userId string) (bool, error) {
+	n, err := db.Collection(GroupJoinRequestCollection).CountDocuments(
+		context.Background(),
+		bson.M{"group_id": groupId, "user_id": userId, "status": JoinRequestPending},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetPendingJoinRequests returns the pending join requests of the group, oldest first
+func GetPendingJoinRequests(db *mongo.Database, groupId string) ([]*GroupJoinRequest, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(GroupJoinRequestCollection).Find(
+		ctx,
+		bson.M{"group_id": groupId, "status": JoinRequestPending},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	reqs := make([]*GroupJoinRequest, 0)
+	if err = cursor.All(ctx, &reqs); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// DecideJoinRequest atomically approves or rejects a pending join request of the group
+func DecideJoinRequest(db *mongo.Database, groupId string, id string, status string, adminId string, now int64) (*GroupJoinRequest, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrJoinRequestNotFound
+	}
+	var req GroupJoinRequest
+	err = db.Collection(GroupJoinRequestCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId, "group_id": groupId, "status": JoinRequestPending},
+		bson.M{"$set": bson.M{"status": status, "decided_by": adminId, "decided_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&req)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrJoinRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func EnsureInviteIndexes(db *mongo.Database) error {
+	ctx := context.Background()
+	_, err := db.Collection(GroupInviteCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection(GroupJoinRequestCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	return err
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MediaCollection = "media"
+
+	MediaStatusProcessing = "processing"
+	MediaStatusReady      = "ready"
+	MediaStatusFailed     = "failed"
+)
+
+var (
+	ErrMediaNotFound = errors.New("media not found")
+)
+
+// Media is an uploaded file, the content lives in the blob store under Key
+type Media struct {
+	ObjectId  primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	OwnerId   string             `bson:"owner_id" json:"owner_id"`
+	Key       string             `bson:"key" json:"-"`
+	FileName  string             `bson:"file_name" json:"file_name"`
+	MimeType  string             `bson:"mime_type" json:"mime_type"`
+	Size      int64              `bson:"size" json:"size"`
+	CreatedAt int64              `bson:"created_at" json:"created_at"`
+	// Status is processing until thumbnails and metadata of an image are extracted
+	Status     string            `bson:"status" json:"status"`
+	Width      int               `bson:"width,omitempty" json:"width,omitempty"`
+	Height     int               `bson:"height,omitempty" json:"height,omitempty"`
+	Blurhash   string            `bson:"blurhash,omitempty" json:"blurhash,omitempty"`
+	Thumbnails []*MediaThumbnail `bson:"thumbnails,omitempty" json:"thumbnails,omitempty"`
+	// Url is a signed download url, never stored
+	Url string `bson:"-" json:"url,omitempty"`
+}
+
+type MediaThumbnail struct {
+	// Size is the maximum side length the thumbnail was generated for
+	Size   int    `bson:"size" json:"size"`
+	Key    string `bson:"key" json:"-"`
+	Width  int    `bson:"width" json:"width"`
+	Height int    `bson:"height" json:"height"`
+	// ByteSize and MimeType describe the stored thumbnail file
+	ByteSize int64  `bson:"byte_size" json:"byte_size"`
+	MimeType string `bson:"mime_type" json:"mime_type"`
+	Url      string `bson:"-" json:"url,omitempty"`
+}
+
+func (m *Media) FindById(db *mongo.Database, id string) error {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrMediaNotFound
+	}
+	err = db.Collection(MediaCollection).FindOne(context.Background(), bson.M{"_id": objId}).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return ErrMediaNotFound
+	}
+	return err
+}
+
+// Save inserts or replaces the media, an id is generated if not set
+func (m *Media) Save(db *mongo.Database) error {
+	if m.ObjectId.IsZero() {
+		m.ObjectId = primitive.NewObjectID()
+	}
+	_, err := db.Collection(MediaCollection).ReplaceOne(
+		context.Background(),
+		bson.M{"_id": m.ObjectId},
+		&m,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// GetOwnedMedia returns the media with given ids owned by ownerId, in the given order
+func GetOwnedMedia(db *mongo.Database, ownerId string, ids []string) ([]*Media, error) {
+	ctx := context.Background()
+	objIds := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, ErrMediaNotFound
+		}
+		objIds = append(objIds, objId)
+	}
+	cursor, err := db.Collection(MediaCollection).Find(ctx, bson.M{"_id": bson.M{"$in": objIds}, "owner_id": ownerId})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	found := make(map[string]*Media)
+	for cursor.Next(ctx) {
+		var m Media
+		if err := cursor.Decode(&m); err != nil {
+			return nil, err
+		}
+		found[m.ObjectId.Hex()] = &m
+	}
+	media := make([]*Media, 0, len(ids))
+	for _, id := range ids {
+		m, ok := found[id]
+		if !ok {
+			return nil, ErrMediaNotFound
+		}
+		media = append(media, m)
+	}
+	return media, nil
+}
+
+// GetStaleProcessingMedia returns media still processing which were uploaded before the given time
+func GetStaleProcessingMedia(db *mongo.Database, before int64, limit int) ([]*Media, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(MediaCollection).Find(
+		ctx,
+		bson.M{"status": MediaStatusProcessing, "created_at": bson.M{"$lt": before}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	media := make([]*Media, 0)
+	if err = cursor.All(ctx, &media); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// FindByKey finds the media whose original or one of its thumbnails is stored under key
+func (m *Media) FindByKey(db *mongo.Database, key string) error {
+	err := db.Collection(MediaCollection).FindOne(
+		context.Background(),
+		bson.M{"$or": bson.A{bson.M{"key": key}, bson.M{"thumbnails.key": key}}},
+	).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return ErrMediaNotFound
+	}
+	return err
+}
+
+// IsReady tells whether the original can be served, media uploaded before processing existed have no status
+func (m *Media) IsReady() bool {
+	return m.Status == MediaStatusReady || m.Status == ""
+}
+
+// Thumbnail returns the thumbnail stored under key, nil if key is not one of the thumbnails
+func (m *Media) Thumbnail(key string) *MediaThumbnail {
+	for _, thumb := range m.Thumbnails {
+		if thumb.Key == key {
+			return thumb
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrPinLimit        = errors.New("too many pinned chats in the conversation")
+	ErrChatNotPinnable = errors.New("chat cannot be pinned or is already pinned")
+	ErrChatNotPinned   = errors.New("chat is not pinned")
+)
+
+const (
+	// PinSlotCollection keeps the ids of the pinned chats of every conversation,
+	// it is the atomic counter behind the pin limit
+	PinSlotCollection = "pin_slots"
+)
+
+// PinSlots is the set of pinned chat ids of a conversation
+type PinSlots struct {
+	ChatId     string   `bson:"_id" json:"chat_id"`
+	MessageIds []string `bson:"message_ids" json:"message_ids"`
+}
+
+// PinChat pins a chat of the conversation unless the conversation already has maxPins pinned chats,
+// zero for no limit. The slot is reserved atomically before the chat is marked pinned. Returns the pinned chat.
+func PinChat(db *mongo.Database, chatId string, id string, userId string, maxPins int, now int64) (*Chat, error) {
+	ctx := context.Background()
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrChatNotPinnable
+	}
+	reserved, err := reservePinSlot(db, chatId, id, maxPins)
+	if err != nil {
+		return nil, err
+	}
+	if !reserved {
+		return nil, ErrChatNotPinnable
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":       objId,
+			"chat_id":   chatId,
+			"type":      bson.M{"$ne": ChatTypeInfo},
+			"deleted":   bson.M{"$ne": true},
+			"pinned_at": bson.M{"$exists": false},
+		},
+		bson.M{"$set": bson.M{"pinned_at": now, "pinned_by": userId}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err != nil {
+		if releaseErr := releasePinSlot(db, chatId, id); releaseErr != nil {
+			return nil, releaseErr
+		}
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrChatNotPinnable
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// reservePinSlot adds id to the pinned chats of the conversation while it has less than maxPins,
+// zero for no limit. Returns false if id already has a slot, ErrPinLimit if the conversation is full.
+func reservePinSlot(db *mongo.Database, chatId string, id string, maxPins int) (bool, error) {
+	filter := bson.M{"_id": chatId}
+	if maxPins > 0 {
+		// The last allowed index must be free, unless the chat already holds a slot
+		filter["$or"] = bson.A{
+			bson.M{"message_ids": id},
+			bson.M{"message_ids." + strconv.Itoa(maxPins-1): bson.M{"$exists": false}},
+		}
+	}
+	res, err := db.Collection(PinSlotCollection).UpdateOne(
+		context.Background(),
+		filter,
+		bson.M{"$addToSet": bson.M{"message_ids": id}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// The conversation has slots but the filter did not match, it is full
+		return false, ErrPinLimit
+	}
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+// releasePinSlot frees the slot of id in the conversation if it has one
+func releasePinSlot(db *mongo.Database, chatId string, id string) error {
+	_, err := db.Collection(PinSlotCollection).UpdateOne(
+		context.Background(),
+		bson.M{"_id": chatId},
+		bson.M{"$pull": bson.M{"message_ids": id}},
+	)
+	return err
+}
+
+// UnpinChat unpins a pinned chat of the conversation. Returns the unpinned chat.
+func UnpinChat(db *mongo.Database, chatId string, id string) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrChatNotPinned
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId, "chat_id": chatId, "pinned_at": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"pinned_at": "", "pinned_by": ""}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrChatNotPinned
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = releasePinSlot(db, chatId, id); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetPinnedChats returns the pinned chats of the conversation, most recently pinned first
+func GetPinnedChats(db *mongo.Database, chatId string) ([]*Chat, error) {
+	ctx := context.Background()
+	cursor, err := db.Collection(ChatCollection).Find(
+		ctx,
+		bson.M{"chat_id": chatId, "pinned_at": bson.M{"$exists": true}},
+		options.Find().SetSort(bson.D{{Key: "pinned_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	chats := make([]*Chat, 0)
+	if err = cursor.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+func EnsurePinIndexes(db *mongo.Database) error {
+	_, err := db.Collection(ChatCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "chat_id", Value: 1}, {Key: "pinned_at", Value: -1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"pinned_at": bson.M{"$exists": true}}),
+	})
+	return err
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	PresenceCollection = "presence_sessions"
+)
+
+// PresenceSession is a live websocket session of a user on any node. Sessions are refreshed by
+// a heartbeat and expire on their own, so a crashed node cannot leave its users online.
+type PresenceSession struct {
+	// Id is the websocket session id
+	Id          string    `bson:"_id" json:"id"`
+	UserId      string    `bson:"user_id" json:"user_id"`
+	ConnectedAt int64     `bson:"connected_at" json:"connected_at"`
+	ExpiresAt   time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// StartPresenceSession records a live session of the user
+func StartPresenceSession(db *mongo.Database, sessionId string, userId string, now time.Time, ttl time.Duration) error {
+	_, err := db.Collection(PresenceCollection).UpdateOne(
+		context.Background(),
+		bson.M{"_id": sessionId},
+		bson.M{
+			"$set":         bson.M{"user_id": userId, "expires_at": now.Add(ttl)},
+			"$setOnInsert": bson.M{"connected_at": now.UnixMilli()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// RefreshPresenceSession extends the expiry of a live session
+func RefreshPresenceSession(db *mongo.Database, sessionId string, now time.Time, ttl time.Duration) error {
+	_, err := db.Collection(PresenceCollection).UpdateOne(
+		context.Background(),
+		bson.M{"_id": sessionId},
+		bson.M{"$set": bson.M{"expires_at": now.Add(ttl)}},
+	)
+	return err
+}
+
+// EndPresenceSession removes a session and returns the user's remaining live session count
+func EndPresenceSession(db *mongo.Database, sessionId string, userId string, now time.Time) (int, error) {
+	_, err := db.Collection(PresenceCollection).DeleteOne(context.Background(), bson.M{"_id": sessionId})
+	if err != nil {
+		return 0, err
+	}
+	return CountPresenceSessions(db, userId, now)
+}
+
+// CountPresenceSessions returns the number of sessions of the user which have not expired.
+// Expired sessions are also filtered here since the TTL monitor only runs periodically.
+func CountPresenceSessions(db *mongo.Database, userId string, now time.Time) (int, error) {
+	n, err := db.Collection(PresenceCollection).CountDocuments(
+		context.Background(),
+		bson.M{"user_id": userId, "expires_at": bson.M{"$gt": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// IsOnline tells whether the user has at least one live session
+func IsOnline(db *mongo.Database, userId string) (bool, error) {
+	n, err := CountPresenceSessions(db, userId, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func EnsurePresenceIndexes(db *mongo.Database) error {
+	_, err := db.Collection(PresenceCollection).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "expires_at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MaxSnippetLength is the number of characters of a quoted text kept in a reply
+	MaxSnippetLength = 100
+)
+
+// ChatReplyRef is a denormalized quote of the chat a reply refers to
+type ChatReplyRef struct {
+	MessageId string `bson:"message_id" json:"message_id"`
+	SenderId  string `bson:"sender_id" json:"sender_id"`
+	Type      string `bson:"type" json:"type"`
+	Snippet   string `bson:"snippet" json:"snippet"`
+	// Deleted is set once the quoted chat is deleted for everyone, the snippet is cleared then
+	Deleted bool `bson:"deleted,omitempty" json:"deleted,omitempty"`
+}
+
+// ThreadInfo is kept on the root chat of a thread
+type ThreadInfo struct {
+	ReplyCount int `bson:"reply_count" json:"reply_count"`
+	// ParticipantIds are the root sender and every user who replied in the thread
+	ParticipantIds []string `bson:"participant_ids" json:"participant_ids"`
+	LastReplyAt    int64    `bson:"last_reply_at" json:"last_reply_at"`
+}
+
+// Snippet returns a short text representing the chat when quoted
+func (c *Chat) Snippet() string {
+	text := c.Text
+	if c.Poll != nil {
+		text = c.Poll.Question
+	}
+	if text == "" && (c.Type == ChatTypeImage || c.Type == ChatTypeFile) {
+		text = "[" + c.Type + "]"
+	}
+	runes := []rune(text)
+	if len(runes) > MaxSnippetLength {
+		return string(runes[:MaxSnippetLength]) + "…"
+	}
+	return text
+}
+
+// ReplyRef returns the quote of the chat for a reply
+func (c *Chat) ReplyRef() *ChatReplyRef {
+	return &ChatReplyRef{
+		MessageId: c.ObjectId.Hex(),
+		SenderId:  c.SenderId,
+		Type:      c.Type,
+		Snippet:   c.Snippet(),
+	}
+}
+
+// AddThreadReply atomically counts a reply of userId in the thread rooted at rootId. Returns the updated root.
+func AddThreadReply(db *mongo.Database, rootId string, userId string, now int64) (*Chat, error) {
+	objId, err := primitive.ObjectIDFromHex(rootId)
+	if err != nil {
+		return nil, err
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"thread.reply_count": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$thread.reply_count", 0}}, 1}},
+			"thread.participant_ids": bson.M{"$setUnion": bson.A{
+				bson.M{"$ifNull": bson.A{"$thread.participant_ids", bson.A{"$sender_id"}}},
+				bson.A{userId},
+			}},
+			"thread.last_reply_at": now,
+		}}},
+	}
+	var c Chat
+	err = db.Collection(ChatCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": objId},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// EnsureThreadIndexes creates the index used to paginate thread history
+// updateReplyRefs rewrites the quote of the chat id in every reply of the conversation
+func updateReplyRefs(db *mongo.Database, chatId string, id string, snippet string, deleted bool) error {
+	_, err := db.Collection(ChatCollection).UpdateMany(
+		context.Background(),
+		bson.M{"chat_id": chatId, "reply_to.message_id": id},
+		bson.M{"$set": bson.M{"reply_to.snippet": snippet, "reply_to.deleted": deleted}},
+	)
+	return err
+}
+
+func EnsureThreadIndexes(db *mongo.Database) error {
+	_, err := db.Collection(ChatCollection).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "thread_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "reply_to.message_id", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	return err
+}
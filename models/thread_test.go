@@ -0,0 +1,38 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestReplyQuotesFollowEditAndDelete(t *testing.T) {
+	db := testDatabase(t)
+	chatId := DirectConversationId("u_sender", "u_receiver")
+	quoted := &Chat{SenderId: "u_sender", ChatId: chatId, Type: ChatTypeText, Text: "original", CreatedAt: 100}
+	if err := quoted.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	reply := &Chat{SenderId: "u_receiver", ChatId: chatId, Type: ChatTypeText, Text: "reply", CreatedAt: 200, ReplyTo: quoted.ReplyRef()}
+	if err := reply.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EditChat(db, quoted.ObjectId.Hex(), "u_sender", "edited", 0, 300); err != nil {
+		t.Fatal(err)
+	}
+	var stored Chat
+	if err := stored.FindById(db, chatId, reply.ObjectId.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if stored.ReplyTo.Snippet != "edited" || stored.ReplyTo.Deleted {
+		t.Fatalf("quote not refreshed after edit: %+v", stored.ReplyTo)
+	}
+	if _, err := DeleteChatForEveryone(db, quoted.ObjectId.Hex(), "u_sender", 400); err != nil {
+		t.Fatal(err)
+	}
+	stored = Chat{}
+	if err := stored.FindById(db, chatId, reply.ObjectId.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if stored.ReplyTo.Snippet != "" || !stored.ReplyTo.Deleted {
+		t.Fatalf("quote not cleared after delete: %+v", stored.ReplyTo)
+	}
+}
@@ -19,14 +19,17 @@ var (
 )
 
 type User struct {
-	Id        string `json:"id" gorm:"primaryKey"`
-	Username  string `json:"username"`
-	Password  string `json:"-"`
-	Name      string `json:"name"`
-	Location  string `json:"location"`
-	ImageUrl  string `json:"image_url"`
-	CreatedAt int64  `json:"created_at" gorm:"autoCreateTime:milli"`
-	UpdatedAt int64  `json:"updated_at" gorm:"autoUpdateTime:milli"`
+	Id       string `json:"id" gorm:"primaryKey"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	ImageUrl string `json:"image_url"`
+	// LastSeen is when the user's last session disconnected, exposed through presence only
+	LastSeen     int64 `json:"-"`
+	HideLastSeen bool  `json:"hide_last_seen"`
+	CreatedAt    int64 `json:"created_at" gorm:"autoCreateTime:milli"`
+	UpdatedAt    int64 `json:"updated_at" gorm:"autoUpdateTime:milli"`
 }
 
 func NewUserId() string {
@@ -80,6 +83,17 @@ func (u *User) FindById(db *gorm.DB, id string) error {
 	return nil
 }
 
+// UpdateLastSeen sets last seen without touching updated_at
+func (u *User) UpdateLastSeen(db *gorm.DB, lastSeen int64) error {
+	u.LastSeen = lastSeen
+	return db.Model(&User{Id: u.Id}).UpdateColumn("last_seen", lastSeen).Error
+}
+
+func (u *User) UpdateHideLastSeen(db *gorm.DB, hide bool) error {
+	u.HideLastSeen = hide
+	return db.Model(&User{Id: u.Id}).Update("hide_last_seen", hide).Error
+}
+
 func (u *User) ComparePassword(db *gorm.DB, rawPwd string) error {
 	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(rawPwd))
 	if err != nil {
@@ -99,3 +113,20 @@ func GetUsers(db *gorm.DB, offset int, limit int) ([]*User, error) {
 	}
 	return users, nil
 }
+
+// GetUsersByIds returns the users with given ids, keyed by id
+func GetUsersByIds(db *gorm.DB, ids []string) (map[string]*User, error) {
+	users := make(map[string]*User)
+	if len(ids) == 0 {
+		return users, nil
+	}
+	var found []*User
+	tx := db.Where("id IN ?", ids).Find(&found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for _, u := range found {
+		users[u.Id] = u
+	}
+	return users, nil
+}
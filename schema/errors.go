@@ -11,6 +11,8 @@ const (
 	ErrTokenInvalid           int = 10001
 	ErrTokenExpired           int = 10002
 	ErrEmailOrPasswordInvalid int = 10003
+	// Permissions
+	ErrPermissionDenied int = 20000
 	// Requests
 	ErrUnparsableJSON       int = 40000
 	ErrFieldRequired        int = 40001
@@ -21,6 +23,8 @@ const (
 	ErrPasswordMinChar      int = 40012
 	ErrPasswordMaxChar      int = 40013
 	ErrUsernameAlreadyTaken int = 40021
+	ErrFileTooLarge         int = 40031
+	ErrFileTypeNotAllowed   int = 40032
 	// Resource general
 	ErrResourceNotFound int = 60000
 	// Internal
@@ -9,6 +9,7 @@ import (
 	"github.com/krissukoco/go-gin-chat/controllers"
 	"github.com/krissukoco/go-gin-chat/middlewares"
 	"github.com/krissukoco/go-gin-chat/security"
+	"github.com/krissukoco/go-gin-chat/storage"
 )
 
 func newDefaultRouter() *gin.Engine {
@@ -50,25 +51,75 @@ func (srv *Server) setupRouter() error {
 		Pg: srv.Pg,
 	}
 	chatCtl := controllers.Chat{
+		Mongo:          srv.Mongo,
+		UserCtl:        &userCtl,
+		Hub:            srv.Hub,
+		Access:         controllers.NewAuthorizer(srv.Mongo),
+		EditWindow:     srv.EditWindow,
+		ReactionConfig: srv.ReactionConfig,
+		MaxPins:        srv.MaxPins,
+		Typing:         controllers.NewTypingTracker(controllers.DefaultTypingExpiry, controllers.DefaultTypingThrottle),
+		JwtSecret:      jwtSecret,
+		ClientConfig:   srv.ClientConfig,
+	}
+	mediaCtl := controllers.Media{
 		Mongo:     srv.Mongo,
-		UserCtl:   &userCtl,
-		JwtSecret: jwtSecret,
+		Store:     srv.Store,
+		ChatCtl:   &chatCtl,
+		MaxSize:   controllers.DefaultMediaMaxSize,
+		UrlExpiry: controllers.DefaultMediaUrlExpiry,
+		Processor: srv.MediaProcessor,
 	}
 	groupCtl := controllers.Group{
-		Mongo: srv.Mongo,
+		Mongo:    srv.Mongo,
+		ChatCtl:  &chatCtl,
+		MediaCtl: &mediaCtl,
 	}
+	chatCtl.GroupCtl = &groupCtl
 	router.POST("/auth/login", authCtl.Login)
 	router.POST("/auth/register", authCtl.Register)
 	router.GET("/auth/account", authMiddleware.AuthorizationHeader, authCtl.GetAccount)
+	router.PUT("/auth/account/privacy", authMiddleware.AuthorizationHeader, authCtl.UpdatePrivacy)
+	router.GET("/auth/sessions", authMiddleware.AuthorizationHeader, chatCtl.GetSessions)
 	router.GET("/users", userCtl.GetAll)
 	router.GET("/users/:id", userCtl.GetById)
+	router.GET("/users/:id/presence", authMiddleware.AuthorizationHeader, chatCtl.GetUserPresence)
 	router.GET("/chats", authMiddleware.AuthorizationHeader, chatCtl.GetAll)
+	router.GET("/chats/:chatId/messages", authMiddleware.AuthorizationHeader, chatCtl.GetChatMessages)
+	router.PATCH("/chats/:chatId/messages/:messageId", authMiddleware.AuthorizationHeader, chatCtl.PatchChatMessage)
+	router.DELETE("/chats/:chatId/messages/:messageId", authMiddleware.AuthorizationHeader, chatCtl.DeleteChatMessage)
+	router.GET("/chats/:chatId/messages/:messageId/thread", authMiddleware.AuthorizationHeader, chatCtl.GetChatThread)
+	router.GET("/chats/:chatId/messages/:messageId/receipts", authMiddleware.AuthorizationHeader, chatCtl.GetChatReceipts)
+	router.GET("/conversations/:id/pins", authMiddleware.AuthorizationHeader, chatCtl.GetConversationPins)
+	router.POST("/conversations/:id/pins/:messageId", authMiddleware.AuthorizationHeader, chatCtl.PostConversationPin)
+	router.DELETE("/conversations/:id/pins/:messageId", authMiddleware.AuthorizationHeader, chatCtl.DeleteConversationPin)
+	router.GET("/groups", authMiddleware.AuthorizationHeader, groupCtl.GetAll)
 	router.POST("/groups", authMiddleware.AuthorizationHeader, groupCtl.CreateNew)
+	router.GET("/groups/:id", authMiddleware.AuthorizationHeader, groupCtl.GetById)
+	router.PATCH("/groups/:id", authMiddleware.AuthorizationHeader, groupCtl.Update)
+	router.POST("/groups/:id/members", authMiddleware.AuthorizationHeader, groupCtl.PostMembers)
+	router.DELETE("/groups/:id/members/:userId", authMiddleware.AuthorizationHeader, groupCtl.DeleteMember)
+	router.POST("/groups/:id/leave", authMiddleware.AuthorizationHeader, groupCtl.PostLeave)
+	router.POST("/groups/:id/admins/:userId", authMiddleware.AuthorizationHeader, groupCtl.PostAdmin)
+	router.DELETE("/groups/:id/admins/:userId", authMiddleware.AuthorizationHeader, groupCtl.DeleteAdmin)
+	router.PUT("/groups/:id/owner", authMiddleware.AuthorizationHeader, groupCtl.PutOwner)
+	router.POST("/groups/:id/invites", authMiddleware.AuthorizationHeader, groupCtl.PostInvite)
+	router.GET("/groups/:id/invites", authMiddleware.AuthorizationHeader, groupCtl.GetInvites)
+	router.DELETE("/groups/:id/invites/:code", authMiddleware.AuthorizationHeader, groupCtl.DeleteInvite)
+	router.POST("/groups/join/:code", authMiddleware.AuthorizationHeader, groupCtl.PostJoin)
+	router.GET("/groups/:id/join-requests", authMiddleware.AuthorizationHeader, groupCtl.GetJoinRequests)
+	router.POST("/groups/:id/join-requests/:requestId/approve", authMiddleware.AuthorizationHeader, groupCtl.PostApproveJoinRequest)
+	router.POST("/groups/:id/join-requests/:requestId/reject", authMiddleware.AuthorizationHeader, groupCtl.PostRejectJoinRequest)
+	router.POST("/media", authMiddleware.AuthorizationHeader, mediaCtl.Upload)
+	router.GET("/media/:id", authMiddleware.AuthorizationHeader, mediaCtl.GetById)
+	if local, ok := srv.Store.(*storage.Local); ok {
+		// Signed urls of the local store are served by the API itself
+		router.GET("/media/blob/*key", mediaCtl.ServeLocalBlob(local))
+	}
+	router.GET("/metrics/ws", authMiddleware.AuthorizationHeader, chatCtl.GetWsMetrics)
 	// Websockets
 	ws := router.Group("/ws", middlewares.WebsocketMiddleware)
-	ws.GET("/chats", func(c *gin.Context) {
-		chatCtl.ChatWebsocketHandler(c, srv.NewClient)
-	})
+	ws.GET("/chats", chatCtl.ChatWebsocketHandler)
 
 	srv.Engine = router
 	return nil
@@ -2,13 +2,18 @@ package server
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/krissukoco/go-gin-chat/broker"
 	"github.com/krissukoco/go-gin-chat/controllers"
 	"github.com/krissukoco/go-gin-chat/database"
 	"github.com/krissukoco/go-gin-chat/models"
+	"github.com/krissukoco/go-gin-chat/storage"
 	"go.mongodb.org/mongo-driver/mongo"
 	"gorm.io/gorm"
 )
@@ -19,7 +24,21 @@ type Server struct {
 	Mongo     *mongo.Database
 	WsManager *WebsocketManager
 	Port      int
-	NewClient chan *controllers.ChatClient
+	Hub       *controllers.WsHub
+	Store     storage.BlobStore
+	// MediaProcessor processes uploaded images in the background
+	MediaProcessor *controllers.MediaProcessor
+	// ClientConfig configures the outbound queue of websocket clients
+	ClientConfig controllers.ChatClientConfig
+	// ReactionConfig restricts the reactions users can add
+	ReactionConfig controllers.ReactionConfig
+	// MaxPins is the limit of pinned chats per conversation, zero for no limit
+	MaxPins int
+	// EditWindow is how long after sending a chat can be edited, zero for no limit
+	EditWindow time.Duration
+	stop       chan bool
+	// done is closed once the websocket manager has shut down
+	done chan struct{}
 }
 
 func NewDefaultServer() (*Server, error) {
@@ -42,17 +61,37 @@ func NewDefaultServer() (*Server, error) {
 		}
 	}
 
-	wsManager := NewWebsocketManager()
+	// Broker to fan websocket messages out to every node
+	wsBroker, err := broker.NewBroker()
+	if err != nil {
+		return nil, err
+	}
+
+	// Blob store for uploaded media
+	blobStore, err := storage.NewBlobStore()
+	if err != nil {
+		return nil, err
+	}
+
+	hub := controllers.NewWsHub()
+	wsManager := NewWebsocketManager(hub, wsBroker)
 
 	// Router
 	srv := &Server{
-		Pg:        pg,
-		Mongo:     mongoDb,
-		Port:      defaultPort,
-		WsManager: wsManager,
-		NewClient: make(chan *controllers.ChatClient),
+		Pg:             pg,
+		Mongo:          mongoDb,
+		Port:           defaultPort,
+		WsManager:      wsManager,
+		Hub:            hub,
+		Store:          blobStore,
+		MediaProcessor: controllers.NewMediaProcessor(mongoDb, blobStore, hub, 256),
+		ClientConfig:   chatClientConfigFromEnv(),
+		ReactionConfig: reactionConfigFromEnv(),
+		MaxPins:        maxPinsFromEnv(),
+		EditWindow:     editWindowFromEnv(),
+		stop:           make(chan bool),
+		done:           make(chan struct{}),
 	}
-	srv.WsManager.IncomingClient = srv.NewClient
 	err = srv.setupRouter()
 	if err != nil {
 		return nil, err
@@ -61,15 +100,129 @@ func NewDefaultServer() (*Server, error) {
 	srv.databaseAutoMigrate()
 
 	// Run WS manager
-	stop := make(chan bool)
-	go srv.WsManager.Run(stop)
+	go func() {
+		srv.WsManager.Run(srv.stop)
+		close(srv.done)
+	}()
+	// Run media processing workers
+	srv.MediaProcessor.Start(2)
 	return srv, nil
 }
 
+// chatClientConfigFromEnv reads WS_SEND_QUEUE_SIZE, WS_SEND_QUEUE_POLICY and the
+// WS_WRITE_TIMEOUT, WS_PING_INTERVAL, WS_PONG_TIMEOUT, WS_IDLE_TIMEOUT, WS_MAX_LIFETIME durations (seconds)
+func chatClientConfigFromEnv() controllers.ChatClientConfig {
+	config := controllers.DefaultChatClientConfig()
+	if v, ok := os.LookupEnv("WS_SEND_QUEUE_SIZE"); ok {
+		if size, err := strconv.Atoi(v); err == nil && size > 0 {
+			config.SendQueueSize = size
+		}
+	}
+	if v, ok := os.LookupEnv("WS_SEND_QUEUE_POLICY"); ok {
+		switch v {
+		case controllers.QueuePolicyDrop, controllers.QueuePolicyDisconnect, controllers.QueuePolicyCoalesce:
+			config.QueuePolicy = v
+		}
+	}
+	if v, ok := os.LookupEnv("WS_MAX_BATCH_BYTES"); ok {
+		if size, err := strconv.Atoi(v); err == nil && size > 0 {
+			config.MaxBatchBytes = size
+		}
+	}
+	durations := map[string]*time.Duration{
+		"WS_WRITE_TIMEOUT": &config.WriteTimeout,
+		"WS_PING_INTERVAL": &config.PingInterval,
+		"WS_PONG_TIMEOUT":  &config.PongTimeout,
+		"WS_IDLE_TIMEOUT":  &config.IdleTimeout,
+		"WS_MAX_LIFETIME":  &config.MaxLifetime,
+	}
+	for key, target := range durations {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			*target = time.Duration(sec) * time.Second
+		}
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = controllers.DefaultChatClientConfig().WriteTimeout
+	}
+	if config.PongTimeout > 0 && (config.PingInterval <= 0 || config.PingInterval >= config.PongTimeout) {
+		// Without a ping before the pong timeout every healthy client would be evicted
+		log.Printf("WS_PING_INTERVAL (%s) must be less than WS_PONG_TIMEOUT (%s), using %s",
+			config.PingInterval, config.PongTimeout, config.PongTimeout/2)
+		config.PingInterval = config.PongTimeout / 2
+	}
+	return config
+}
+
+// reactionConfigFromEnv reads REACTIONS_ALLOWED (comma separated emojis) and REACTIONS_MAX_PER_CHAT
+func reactionConfigFromEnv() controllers.ReactionConfig {
+	config := controllers.DefaultReactionConfig()
+	if v, ok := os.LookupEnv("REACTIONS_ALLOWED"); ok {
+		for _, emoji := range strings.Split(v, ",") {
+			if emoji = strings.TrimSpace(emoji); emoji != "" {
+				config.Allowed = append(config.Allowed, emoji)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("REACTIONS_MAX_PER_CHAT"); ok {
+		if max, err := strconv.Atoi(v); err == nil && max >= 0 {
+			config.MaxPerChat = max
+		}
+	}
+	return config
+}
+
+// maxPinsFromEnv reads PINS_MAX_PER_CHAT
+func maxPinsFromEnv() int {
+	if v, ok := os.LookupEnv("PINS_MAX_PER_CHAT"); ok {
+		if max, err := strconv.Atoi(v); err == nil && max >= 0 {
+			return max
+		}
+	}
+	return controllers.DefaultMaxPins
+}
+
+// editWindowFromEnv reads EDIT_WINDOW in seconds, zero for no limit
+func editWindowFromEnv() time.Duration {
+	if v, ok := os.LookupEnv("EDIT_WINDOW"); ok {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			return time.Duration(sec) * time.Second
+		}
+	}
+	return controllers.DefaultEditWindow
+}
+
 func (srv *Server) databaseAutoMigrate() {
 	srv.Pg.AutoMigrate(&models.User{})
+	if err := models.EnsureChatIndexes(srv.Mongo); err != nil {
+		log.Println("ERROR creating chat indexes: ", err)
+	}
+	if err := models.EnsureConversationIndexes(srv.Mongo); err != nil {
+		log.Println("ERROR creating conversation indexes: ", err)
+	}
+	if err := models.EnsureThreadIndexes(srv.Mongo); err != nil {
+		log.Println("ERROR creating thread indexes: ", err)
+	}
+	if err := models.EnsurePinIndexes(srv.Mongo); err != nil {
+		log.Println("ERROR creating pin indexes: ", err)
+	}
+	if err := models.EnsureInviteIndexes(srv.Mongo); err != nil {
+		log.Println("ERROR creating invite indexes: ", err)
+	}
+	if err := models.EnsurePresenceIndexes(srv.Mongo); err != nil {
+		log.Println("ERROR creating presence indexes: ", err)
+	}
 }
 
 func (srv *Server) Start() {
 	srv.Engine.Run(fmt.Sprintf(":%d", srv.Port))
 }
+
+// Stop stops the websocket manager and blocks until all websocket connections are closed
+func (srv *Server) Stop() {
+	close(srv.stop)
+	<-srv.done
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChatClientConfigClampsPingInterval(t *testing.T) {
+	t.Setenv("WS_PING_INTERVAL", "60")
+	t.Setenv("WS_PONG_TIMEOUT", "30")
+	config := chatClientConfigFromEnv()
+	if config.PingInterval != 15*time.Second {
+		t.Fatalf("expected ping interval 15s, got %s", config.PingInterval)
+	}
+	t.Setenv("WS_PING_INTERVAL", "10")
+	config = chatClientConfigFromEnv()
+	if config.PingInterval != 10*time.Second || config.PongTimeout != 30*time.Second {
+		t.Fatalf("unexpected config %+v", config)
+	}
+}
@@ -1,91 +1,151 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"log"
+	"time"
 
+	"github.com/krissukoco/go-gin-chat/broker"
 	"github.com/krissukoco/go-gin-chat/controllers"
 )
 
+// Default bounds of the backoff between broker subscribe attempts
+const (
+	DefaultMinResubscribeBackoff = 500 * time.Millisecond
+	DefaultMaxResubscribeBackoff = 30 * time.Second
+)
+
+// WebsocketManager publishes hub broadcasts to the broker and delivers
+// every envelope received from the broker to the sessions on this node
 type WebsocketManager struct {
-	ChatClients    []*controllers.ChatClient
-	IncomingClient chan *controllers.ChatClient
+	Hub                   *controllers.WsHub
+	Broker                broker.Broker
+	MinResubscribeBackoff time.Duration
+	MaxResubscribeBackoff time.Duration
 }
 
-func NewWebsocketManager() *WebsocketManager {
+func NewWebsocketManager(hub *controllers.WsHub, b broker.Broker) *WebsocketManager {
 	return &WebsocketManager{
-		ChatClients: make([]*controllers.ChatClient, 0),
+		Hub:                   hub,
+		Broker:                b,
+		MinResubscribeBackoff: DefaultMinResubscribeBackoff,
+		MaxResubscribeBackoff: DefaultMaxResubscribeBackoff,
 	}
 }
 
 func (m *WebsocketManager) RegisterChatClient(client *controllers.ChatClient) {
 	log.Println("Registering chat client: ", client.Id)
-	for _, c := range m.ChatClients {
-		if c.Id == client.Id {
-			return
-		}
+	if !m.Hub.Sessions.Add(client) {
+		return
 	}
-
-	m.ChatClients = append(m.ChatClients, client)
-	log.Printf("Registered chat client: %v\n", client.Id)
+	log.Printf("Registered chat client: %v (user %v, device %v)\n", client.Id, client.UserId, client.Device.Type)
 }
 
 func (m *WebsocketManager) UnregisterChatClient(client *controllers.ChatClient) {
 	log.Println("Removing chat client: ", client.Id)
-	for i, c := range m.ChatClients {
-		if c.Id == client.Id {
-			m.ChatClients = append(m.ChatClients[:i], m.ChatClients[i+1:]...)
-			return
-		}
-	}
+	m.Hub.Sessions.Remove(client)
 }
 
-func (m *WebsocketManager) Broadcast(msg any, userId string) {
-	for _, client := range m.ChatClients {
-		if client.UserId == userId {
+// Deliver sends the envelope message to the local sessions of its users
+func (m *WebsocketManager) Deliver(env *broker.Envelope) {
+	for _, userId := range env.UserIds {
+		for _, client := range m.Hub.Sessions.Clients(userId) {
+			if client.Id == env.ExceptClientId {
+				continue
+			}
 			log.Println("broadcast message to client: ", client.Id)
-			client.Conn.WriteJSON(msg)
+			client.SendRaw(env.Message)
 		}
 	}
 }
 
+// Run blocks on the hub channels until stop is closed or receives a value.
+// A failed or closed broker subscription is retried with exponential backoff,
+// sessions keep registering meanwhile and only miss the messages of the outage.
 func (m *WebsocketManager) Run(stop chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer m.shutdown()
+
+	backoff := m.MinResubscribeBackoff
+	var retry <-chan time.Time
+	scheduleRetry := func() {
+		retry = time.After(backoff)
+		backoff *= 2
+		if backoff > m.MaxResubscribeBackoff {
+			backoff = m.MaxResubscribeBackoff
+		}
+	}
+
+	deliveries, err := m.Broker.Subscribe(ctx)
+	if err != nil {
+		log.Printf("ERROR subscribing to broker, retrying in %v: %v\n", backoff, err)
+		scheduleRetry()
+	}
+	go m.publish(ctx)
 	for {
 		select {
 		case <-stop:
 			return
-		case client := <-m.IncomingClient:
-			if client != nil {
-				m.RegisterChatClient(client)
+		case client := <-m.Hub.Register:
+			m.RegisterChatClient(client)
+		case client := <-m.Hub.Unregister:
+			m.UnregisterChatClient(client)
+		case <-retry:
+			retry = nil
+			deliveries, err = m.Broker.Subscribe(ctx)
+			if err != nil {
+				log.Printf("ERROR subscribing to broker, retrying in %v: %v\n", backoff, err)
+				scheduleRetry()
+				continue
+			}
+			log.Println("Resubscribed to broker")
+		case env, ok := <-deliveries:
+			if !ok {
+				// A nil channel blocks, so the loop waits for the retry instead
+				deliveries = nil
+				log.Printf("Broker subscription closed, resubscribing in %v\n", backoff)
+				scheduleRetry()
+				continue
 			}
-		default:
-			for _, client := range m.ChatClients {
-				select {
-				case <-client.Exited:
-					log.Println("client exited")
-					m.UnregisterChatClient(client)
-				case msg := <-client.Out:
-					log.Println("message from client: ", msg)
-					if msg.Type == "new_chat" {
-						newChat, ok := msg.Data.(*controllers.WsChatData)
-						if !ok {
-							log.Println("invalid message schema for 'new_chat'")
-							continue
-						}
-						if newChat.IsGroup && newChat.Group != nil {
-							// Send to each members of group
-							for _, member := range newChat.Group.MemberIds {
-								m.Broadcast(msg, member)
-							}
-						} else {
-							// Send to user
-							m.Broadcast(msg, newChat.Receiver.Id)
-						}
+			backoff = m.MinResubscribeBackoff
+			m.Deliver(env)
+		}
+	}
+}
 
-					}
-				default:
-					continue
-				}
+// publish forwards hub broadcasts to the broker so every node receives them
+func (m *WebsocketManager) publish(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-m.Hub.Broadcast:
+			msg, err := json.Marshal(b.Message)
+			if err != nil {
+				log.Println("ERROR marshalling broadcast message: ", err)
+				continue
+			}
+			env := &broker.Envelope{
+				UserIds:        b.UserIds,
+				ExceptClientId: b.ExceptClientId,
+				Message:        msg,
+			}
+			if err = m.Broker.Publish(ctx, env); err != nil {
+				log.Println("ERROR publishing to broker: ", err)
 			}
 		}
 	}
 }
+
+// shutdown releases blocked senders and closes every registered connection
+func (m *WebsocketManager) shutdown() {
+	log.Println("Stopping websocket manager")
+	close(m.Hub.Done)
+	for _, client := range m.Hub.Sessions.All() {
+		client.Close()
+	}
+	m.Hub.Sessions.Clear()
+	m.Broker.Close()
+}
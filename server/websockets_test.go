@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krissukoco/go-gin-chat/broker"
+	"github.com/krissukoco/go-gin-chat/controllers"
+)
+
+// flakyBroker fails its first subscribe, closes the second subscription
+// right away and keeps the third one open
+type flakyBroker struct {
+	mu       sync.Mutex
+	attempts int
+	live     chan *broker.Envelope
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, env *broker.Envelope) error {
+	return nil
+}
+
+func (b *flakyBroker) Subscribe(ctx context.Context) (<-chan *broker.Envelope, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	switch b.attempts {
+	case 1:
+		return nil, errors.New("connection refused")
+	case 2:
+		sub := make(chan *broker.Envelope)
+		close(sub)
+		return sub, nil
+	default:
+		return b.live, nil
+	}
+}
+
+func (b *flakyBroker) Close() error {
+	return nil
+}
+
+func (b *flakyBroker) Attempts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempts
+}
+
+func TestWebsocketManagerResubscribes(t *testing.T) {
+	b := &flakyBroker{live: make(chan *broker.Envelope)}
+	m := NewWebsocketManager(controllers.NewWsHub(), b)
+	m.MinResubscribeBackoff = time.Millisecond
+	m.MaxResubscribeBackoff = 5 * time.Millisecond
+	stop := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		m.Run(stop)
+		close(done)
+	}()
+
+	// The live subscription is only read once the manager has resubscribed twice
+	select {
+	case b.live <- &broker.Envelope{UserIds: []string{"u_nobody"}, Message: []byte(`{}`)}:
+	case <-time.After(time.Second):
+		t.Fatalf("manager did not resubscribe, %d attempts", b.Attempts())
+	}
+	select {
+	case <-m.Hub.Done:
+		t.Fatal("hub closed while the manager is running")
+	default:
+	}
+	if attempts := b.Attempts(); attempts != 3 {
+		t.Fatalf("expected 3 subscribe attempts, got %d", attempts)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("manager did not stop")
+	}
+}
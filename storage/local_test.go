@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T) *Local {
+	t.Helper()
+	return &Local{
+		Dir:     filepath.Join(t.TempDir(), "uploads"),
+		BaseUrl: "/media/blob",
+		Secret:  "test-secret",
+	}
+}
+
+func TestLocalRejectsPathTraversal(t *testing.T) {
+	l := newTestLocal(t)
+	ctx := context.Background()
+	keys := []string{"", "../escape", "a/../../escape", "/etc/passwd", "a//b", "./a", "a/..", `..\escape`}
+	for _, key := range keys {
+		if err := l.Put(ctx, key, strings.NewReader("data"), 4, "text/plain"); err != ErrInvalidKey {
+			t.Errorf("Put %q: expected ErrInvalidKey, got %v", key, err)
+		}
+		if _, err := l.Get(ctx, key); err != ErrInvalidKey {
+			t.Errorf("Get %q: expected ErrInvalidKey, got %v", key, err)
+		}
+		if err := l.Delete(ctx, key); err != ErrInvalidKey {
+			t.Errorf("Delete %q: expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(l.Dir), "escape")); !os.IsNotExist(err) {
+		t.Fatal("a blob was written outside the directory")
+	}
+}
+
+func TestLocalPutGetDelete(t *testing.T) {
+	l := newTestLocal(t)
+	ctx := context.Background()
+	key := "media/abc_thumb_256"
+	if err := l.Put(ctx, key, strings.NewReader("data"), 4, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := l.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(b) != "data" {
+		t.Fatalf("unexpected blob %q, %v", b, err)
+	}
+	if err = l.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Get(ctx, key); err != ErrBlobNotFound {
+		t.Fatalf("expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+// signedQuery returns the expires and signature of a signed url
+func signedQuery(t *testing.T, signed string) (int64, string) {
+	t.Helper()
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expires, u.Query().Get("signature")
+}
+
+func TestLocalVerify(t *testing.T) {
+	l := newTestLocal(t)
+	signed, err := l.SignedURL(context.Background(), "abc", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "/media/blob/abc?") {
+		t.Fatalf("unexpected signed url %s", signed)
+	}
+	expires, signature := signedQuery(t, signed)
+	if !l.Verify("abc", expires, signature) {
+		t.Fatal("expected a valid signature")
+	}
+	tampered := []byte(signature)
+	if tampered[0] == 'a' {
+		tampered[0] = 'b'
+	} else {
+		tampered[0] = 'a'
+	}
+	if l.Verify("abc", expires, string(tampered)) {
+		t.Fatal("tampered signature accepted")
+	}
+	if l.Verify("abd", expires, signature) {
+		t.Fatal("signature accepted for another key")
+	}
+	if l.Verify("abc", expires+3600, signature) {
+		t.Fatal("signature accepted with an extended expiry")
+	}
+	other := &Local{Dir: l.Dir, BaseUrl: l.BaseUrl, Secret: "other-secret"}
+	if other.Verify("abc", expires, signature) {
+		t.Fatal("signature accepted with another secret")
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+	if l.Verify("abc", past, sign(l.Secret, "abc", past)) {
+		t.Fatal("expired signature accepted")
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 stores blobs in an S3 compatible bucket, e.g. AWS S3 or MinIO
+type S3 struct {
+	Client *minio.Client
+	Bucket string
+}
+
+func NewS3() (*S3, error) {
+	endpoint, exists := os.LookupEnv("S3_ENDPOINT")
+	if !exists {
+		return nil, errors.New("S3_ENDPOINT is not set")
+	}
+	accessKey, exists := os.LookupEnv("S3_ACCESS_KEY")
+	if !exists {
+		return nil, errors.New("S3_ACCESS_KEY is not set")
+	}
+	secretKey, exists := os.LookupEnv("S3_SECRET_KEY")
+	if !exists {
+		return nil, errors.New("S3_SECRET_KEY is not set")
+	}
+	bucket, exists := os.LookupEnv("S3_BUCKET")
+	if !exists {
+		return nil, errors.New("S3_BUCKET is not set")
+	}
+	useSSL := os.Getenv("S3_USE_SSL") != "false"
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exists, err = client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err = client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_REGION")}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3{Client: client, Bucket: bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.Client.PutObject(ctx, s.Bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.Client.RemoveObject(ctx, s.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.Client.PresignedGetObject(ctx, s.Bucket, key, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestS3PutGetSignedURLDelete runs against the bucket of S3_ENDPOINT, e.g. a local MinIO,
+// it is skipped if unset
+func TestS3PutGetSignedURLDelete(t *testing.T) {
+	if os.Getenv("S3_ENDPOINT") == "" {
+		t.Skip("S3_ENDPOINT is not set")
+	}
+	s, err := NewS3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := fmt.Sprintf("test/%d", time.Now().UnixNano())
+	content := "hello from the s3 test"
+	if err = s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(ctx, key)
+
+	blob, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(b) != content {
+		t.Fatalf("unexpected blob %q, %v", b, err)
+	}
+
+	signed, err := s.SignedURL(ctx, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || res.StatusCode != 200 || string(b) != content {
+		t.Fatalf("signed url returned %d %q, %v", res.StatusCode, b, err)
+	}
+
+	if err = s.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(ctx, key); err != ErrBlobNotFound {
+		t.Fatalf("expected ErrBlobNotFound after delete, got %v", err)
+	}
+}
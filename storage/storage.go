@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+var (
+	ErrStorageUnknown = errors.New("storage type is unknown")
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrInvalidKey     = errors.New("invalid blob key")
+)
+
+// BlobStore stores uploaded media
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a download url of the blob valid for the given duration
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// NewBlobStore creates the store selected by STORAGE (local or s3), default is local
+func NewBlobStore() (BlobStore, error) {
+	storageType, exists := os.LookupEnv("STORAGE")
+	if !exists || storageType == "" {
+		storageType = StorageLocal
+	}
+	switch storageType {
+	case StorageLocal:
+		return NewLocal()
+	case StorageS3:
+		return NewS3()
+	default:
+		return nil, ErrStorageUnknown
+	}
+}
+
+// sign returns the HMAC signature of a key valid until expires (unix seconds)
+func sign(secret string, key string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s:%d", key, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}